@@ -21,7 +21,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/sample-controller/pkg/signals"
@@ -31,19 +31,43 @@ import (
 func main() {
 	cp := newCaPaths()
 	mirrors := newMirrorMap()
+	ecrAssumeRoles := newAssumeRoleMap()
 	forceCheckDisabledControllerKindsParser := cli.NewForceCheckDisabledControllerKindsParser()
 
-	imageCheckInterval := flag.Duration("check-interval", time.Minute, "image re-check interval")
+	imageCheckInterval := flag.Duration("check-interval", time.Minute, "image re-check interval, it grows for images whose digest does not change")
+	maxCheckInterval := flag.Duration("max-check-interval", 15*time.Minute, "maximum re-check interval of images whose digest does not change")
+	maxFailureBackoff := flag.Duration("max-failure-backoff", 10*time.Minute, "maximum re-check interval of images that keep failing the check")
+	checkWorkers := flag.Int("check-workers", 5, "number of images checked concurrently")
+	immediateChecksPerSecond := flag.Float64("immediate-checks-per-second", 1, "rate of immediate checks of new images and images of changed controllers")
+	immediateChecksBurst := flag.Int("immediate-checks-burst", 10, "maximum burst of immediate checks above -immediate-checks-per-second, at least 1")
+	maxInFlightPerRegistry := flag.Int("max-in-flight-per-registry", 0, "maximum number of concurrent checks against a single registry, 0 means no limit other than -check-workers")
 	ignoredImagesStr := flag.String("ignored-images", "", "tilde-separated image regexes to ignore, each image will be checked against this list of regexes")
 	allowedImagesStr := flag.String("allowed-images", "", "tilde-separated image regexes to allow, each image will be checked against this list of regexes")
 	bindAddr := flag.String("bind-address", ":8080", "address:port to bind /metrics endpoint to")
 	namespaceLabels := flag.String("namespace-label", "", "namespace label for checks")
 	insecureSkipVerify := flag.Bool("skip-registry-cert-verification", false, "whether to skip registries' certificate verification")
 	plainHTTP := flag.Bool("allow-plain-http", false, "whether to fallback to HTTP scheme for registries that don't support HTTPS") // named after the ctr cli flag
+	rollbackRevisions := flag.Int("rollback-revisions", 0, "number of previous revisions of each Deployment, StatefulSet and DaemonSet whose images are checked to be available for a rollback, 0 disables the check")
+	checkPlatforms := flag.Bool("check-platforms", false, "whether to verify that images have manifests for the OS and architecture of the nodes their workloads may run on")
+	checkPulls := flag.Bool("check-pulls", false, "whether to GET image manifests the way container runtimes do, to detect pulls blocked by registry policies, e.g., vulnerability or signature gates, every such GET counts as a pull against registry rate limits, e.g., of Docker Hub")
+	checkSignatures := flag.Bool("check-signatures", false, "whether to look up cosign signatures of images")
+	signaturePublicKeysStr := flag.String("signature-public-keys", "", "comma-separated paths to PEM encoded public keys that image signatures are verified with, implies -check-signatures")
+	requiredArtifactTypesStr := flag.String("required-artifact-types", "", `comma-separated artifact types that referrers of each image must have, e.g., an SBOM or provenance, "|" separates alternatives, e.g., "application/spdx+json|application/vnd.cyclonedx+json"`)
+	imageMetadata := flag.Bool("image-metadata", false, "whether to export the creation time, compressed size, layer count and annotations of images, fetched once per digest")
+	metadataAnnotationsStr := flag.String("image-metadata-annotations", "org.opencontainers.image.source,org.opencontainers.image.revision", "comma-separated OCI annotations exported as labels of the image info metric with -image-metadata, config labels are used for images without the annotations")
+	strictCredentials := flag.Bool("strict-credentials", false, "whether to check images with the credentials kubelet would use only, without falling back to the default keychain of the exporter, images available with the fallback only are reported by the credentials_mismatch metric")
+	strictCredentialsRegistriesStr := flag.String("strict-credentials-registries", "", "comma-separated registry hosts whose images are checked as with -strict-credentials")
+	credentialProviderConfig := flag.String("image-credential-provider-config", "", "path to a kubelet CredentialProviderConfig file, images matching its plugins are checked with the credentials the plugins return") // named after the kubelet flags
+	credentialProviderBinDir := flag.String("image-credential-provider-bin-dir", "", "path to the directory with the credential provider plugin binaries")
+	googleServiceAccountKey := flag.String("google-service-account-key", "", "path to a service account JSON key file that Artifact Registry and Container Registry access tokens are requested with, the GCE metadata server is used if omitted")
+	deepCheckRegistriesStr := flag.String("deep-check-registries", "", "comma-separated registry hosts whose images are checked to have all config and layer blobs, not just the manifest")
+	deepCheckImagesStr := flag.String("deep-check-images", "", "tilde-separated image regexes, images matching any of them are checked to have all config and layer blobs, not just the manifest")
+	customResourcesConfig := flag.String("custom-resources-config", "", "path to a YAML file that describes custom resources to extract images from")
 	defaultRegistry := flag.String("default-registry", "", fmt.Sprintf("default registry to use in absence of a fully qualified image name, defaults to %q", name.DefaultRegistry))
 	flag.Var(&cp, "capath", "path to a file that contains CA certificates in the PEM format") // named after the curl cli flag
 	flag.Var(&mirrors, "image-mirror", "Add a mirror repository (format: original=mirror)")
-	flag.Func("force-check-disabled-controllers", `comma-separated list of controller kinds for which image is forcibly checked, even when workloads are disabled or suspended. Acceptable values include "Deployment", "StatefulSet", "DaemonSet", "Cronjob" or "*" for all kinds (this option is case-insensitive)`, forceCheckDisabledControllerKindsParser.Parse)
+	flag.Var(&ecrAssumeRoles, "ecr-assume-role", "IAM role to assume to get tokens for the ECR registries of an AWS account (format: account=roleARN)")
+	flag.Func("force-check-disabled-controllers", `comma-separated list of controller kinds for which image is forcibly checked, even when workloads are disabled or suspended. Acceptable values include "Deployment", "StatefulSet", "DaemonSet", "Cronjob", "Job", "ReplicaSet", "ReplicationController", "Pod" or "*" for all kinds (this option is case-insensitive)`, forceCheckDisabledControllerKindsParser.Parse)
 
 	flag.Parse()
 
@@ -53,6 +77,10 @@ func main() {
 	logrus.AddHook(logging.NewPrometheusHook())
 	logrus.Infof("Starting k8s-image-availability-exporter %s", version.Version)
 
+	if err := cli.ValidateImmediateChecks(*immediateChecksPerSecond, *immediateChecksBurst); err != nil {
+		logrus.Fatal(err)
+	}
+
 	// set up signals, so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
 
@@ -66,14 +94,18 @@ func main() {
 		logrus.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
 
-	liveTicksCounter := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "k8s_image_availability_exporter",
-			Name:      "completed_rechecks_total",
-			Help:      "Number of image rechecks completed.",
-		},
-	)
-	prometheus.MustRegister(liveTicksCounter)
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("Error building kubernetes dynamic client: %s", err.Error())
+	}
+
+	var customResources []registry.CustomResourceConfig
+	if *customResourcesConfig != "" {
+		customResources, err = registry.LoadCustomResourceConfigs(*customResourcesConfig)
+		if err != nil {
+			logrus.Fatalf("Error loading custom resources config: %s", err.Error())
+		}
+	}
 
 	var ignoredImgRegexes []regexp.Regexp
 	if *ignoredImagesStr != "" {
@@ -91,6 +123,39 @@ func main() {
 		}
 	}
 
+	var deepCheckRegistries []string
+	if *deepCheckRegistriesStr != "" {
+		deepCheckRegistries = strings.Split(*deepCheckRegistriesStr, ",")
+	}
+
+	var deepCheckImgRegexes []regexp.Regexp
+	if *deepCheckImagesStr != "" {
+		regexStrings := strings.Split(*deepCheckImagesStr, "~")
+		for _, regexStr := range regexStrings {
+			deepCheckImgRegexes = append(deepCheckImgRegexes, *regexp.MustCompile(regexStr))
+		}
+	}
+
+	var signaturePublicKeyPaths []string
+	if *signaturePublicKeysStr != "" {
+		signaturePublicKeyPaths = strings.Split(*signaturePublicKeysStr, ",")
+	}
+
+	var requiredArtifactTypes []string
+	if *requiredArtifactTypesStr != "" {
+		requiredArtifactTypes = strings.Split(*requiredArtifactTypesStr, ",")
+	}
+
+	var metadataAnnotations []string
+	if *metadataAnnotationsStr != "" {
+		metadataAnnotations = strings.Split(*metadataAnnotationsStr, ",")
+	}
+
+	var strictCredentialsRegistries []string
+	if *strictCredentialsRegistriesStr != "" {
+		strictCredentialsRegistries = strings.Split(*strictCredentialsRegistriesStr, ",")
+	}
+
 	registryChecker := registry.NewChecker(
 		stopCh.Done(),
 		kubeClient,
@@ -103,6 +168,31 @@ func main() {
 		*defaultRegistry,
 		*namespaceLabels,
 		mirrors,
+		dynamicClient,
+		customResources,
+		*rollbackRevisions,
+		*checkWorkers,
+		*maxInFlightPerRegistry,
+		*imageCheckInterval,
+		*maxCheckInterval,
+		*maxFailureBackoff,
+		*immediateChecksPerSecond,
+		*immediateChecksBurst,
+		*checkPlatforms,
+		deepCheckRegistries,
+		deepCheckImgRegexes,
+		*checkPulls,
+		*checkSignatures,
+		signaturePublicKeyPaths,
+		requiredArtifactTypes,
+		*imageMetadata,
+		metadataAnnotations,
+		*strictCredentials,
+		strictCredentialsRegistries,
+		*credentialProviderConfig,
+		*credentialProviderBinDir,
+		ecrAssumeRoles,
+		*googleServiceAccountKey,
 	)
 	prometheus.MustRegister(registryChecker)
 
@@ -114,10 +204,7 @@ func main() {
 
 	handlers.UpdateHealth(true)
 
-	wait.Until(func() {
-		registryChecker.Tick()
-		liveTicksCounter.Inc()
-	}, *imageCheckInterval, stopCh.Done())
+	<-stopCh.Done()
 }
 
 /* Custom flag types */
@@ -125,6 +212,7 @@ func main() {
 var (
 	_ flag.Value = (*caPaths)(nil)
 	_ flag.Value = (*mirrorMap)(nil)
+	_ flag.Value = (*assumeRoleMap)(nil)
 )
 
 // caPaths is a custom flag type for a list of paths to CA certificates
@@ -162,3 +250,23 @@ func (m *mirrorMap) Set(value string) error {
 	(*m)[result[0]] = result[1]
 	return nil
 }
+
+// assumeRoleMap is a custom flag type for a map of AWS account IDs to IAM role ARNs
+type assumeRoleMap map[string]string
+
+func newAssumeRoleMap() assumeRoleMap {
+	return make(assumeRoleMap)
+}
+
+func (m *assumeRoleMap) String() string {
+	return fmt.Sprintf("%v", *m)
+}
+
+func (m *assumeRoleMap) Set(value string) error {
+	account, roleARN, ok := strings.Cut(value, "=")
+	if !ok || account == "" || roleARN == "" {
+		return errors.New("invalid format for role, must be account=roleARN")
+	}
+	(*m)[account] = roleARN
+	return nil
+}
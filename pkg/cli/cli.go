@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"slices"
 	"strings"
@@ -40,6 +41,19 @@ flagLoop:
 
 func NewForceCheckDisabledControllerKindsParser() *ForceCheckDisabledControllerKindsParser {
 	parser := &ForceCheckDisabledControllerKindsParser{}
-	parser.allowedControllerKinds = []string{"deployment", "statefulset", "daemonset", "cronjob"}
+	parser.allowedControllerKinds = []string{"deployment", "statefulset", "daemonset", "cronjob", "job", "replicaset", "replicationcontroller", "pod"}
 	return parser
 }
+
+// ValidateImmediateChecks returns an error if immediate checks of the rate and the burst would never be performed,
+// a rate limiter with a zero burst fails to wait for any event.
+func ValidateImmediateChecks(perSecond float64, burst int) error {
+	if perSecond <= 0 {
+		return errors.New("-immediate-checks-per-second must be positive")
+	}
+	if burst < 1 {
+		return errors.New("-immediate-checks-burst must be at least 1")
+	}
+
+	return nil
+}
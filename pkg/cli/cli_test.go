@@ -14,7 +14,7 @@ func Test_ForceCheckDisabledControllerKindsParser(t *testing.T) {
 		goodKinds               = "deployment,statefulset"
 		goodKindsWithDuplicates = "deployment,deployment,statefulset,cronjob,cronjob"
 		goodKindsWithWildcard   = "deployment,statefulset,*"
-		badKinds                = "deployment,job"
+		badKinds                = "deployment,rollout"
 	)
 	parser := NewForceCheckDisabledControllerKindsParser()
 	expectedErr := fmt.Errorf(`must be one of %s or * for all kinds`, strings.Join(parser.allowedControllerKinds, ", "))
@@ -37,3 +37,11 @@ func Test_ForceCheckDisabledControllerKindsParser(t *testing.T) {
 	err = parser.Parse(badKinds)
 	require.Error(t, expectedErr, err)
 }
+
+func Test_ValidateImmediateChecks(t *testing.T) {
+	require.NoError(t, ValidateImmediateChecks(1, 10))
+	require.NoError(t, ValidateImmediateChecks(0.1, 1))
+	require.EqualError(t, ValidateImmediateChecks(0, 10), "-immediate-checks-per-second must be positive")
+	require.EqualError(t, ValidateImmediateChecks(-1, 10), "-immediate-checks-per-second must be positive")
+	require.EqualError(t, ValidateImmediateChecks(1, 0), "-immediate-checks-burst must be at least 1")
+}
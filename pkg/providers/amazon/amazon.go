@@ -4,78 +4,241 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-node-termination-handler/pkg/ec2metadata"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
 )
 
+const (
+	publicRegistry = "public.ecr.aws"
+	// publicRegion is the only region ECR Public issues tokens in.
+	publicRegion = "us-east-1"
+
+	// tokenRefreshPeriod is how long before its expiry a token is refreshed.
+	tokenRefreshPeriod = time.Hour
+	// defaultTokenLifetime is assumed for tokens that come without the expiry time, ECR tokens are valid for 12 hours.
+	defaultTokenLifetime = 12 * time.Hour
+	// tokenRequestTimeout bounds the STS and ECR requests for a token.
+	tokenRequestTimeout = 30 * time.Second
+	// anonymousRetryInterval is how long ECR Public is accessed anonymously after failing to get a token.
+	anonymousRetryInterval = 10 * time.Minute
+)
+
+var privateRegistryRegex = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// registryKey identifies the registry a token is issued for, the account is empty for ECR Public.
+type registryKey struct {
+	account string
+	region  string
+}
+
+type token struct {
+	authConfig authn.AuthConfig
+	anonymous  bool
+	refreshAt  time.Time
+}
+
+func (t token) keychain() authn.Keychain {
+	if t.anonymous {
+		return authn.NewMultiKeychain()
+	}
+
+	return &customKeychain{authenticator: authn.FromConfig(t.authConfig)}
+}
+
 type Provider struct {
-	ecrClient       *ecr.Client
-	authToken       authn.AuthConfig
-	authTokenExpiry time.Time
-	name            string
+	cfg aws.Config
+	// roles maps account IDs to the IAM roles assumed to get tokens for the registries of the accounts.
+	roles map[string]string
+	name  string
+
+	lock   sync.Mutex
+	tokens map[registryKey]token
+	// requests dedupes concurrent token requests for the same registry, the lock is not held while they run.
+	requests singleflight.Group
+	// requestToken is replaced in tests.
+	requestToken func(ctx context.Context, key registryKey) (token, error)
 }
 
-func NewProvider() *Provider {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(requestEC2Region()))
+func NewProvider(roles map[string]string) *Provider {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		logrus.Warn("error while loading config for new aws provider ", err)
 	}
-	ecrClient := ecr.NewFromConfig(cfg)
-	return &Provider{ecrClient: ecrClient, name: "amazon"}
-}
-
-func (p *Provider) GetAuthKeychain(_ string) (authn.Keychain, error) {
-	const bufferPeriod = time.Hour
 
-	if p.authToken.Username != "" && time.Now().Before(p.authTokenExpiry.Add(-bufferPeriod)) {
-		return &customKeychain{authenticator: authn.FromConfig(p.authToken)}, nil
+	p := &Provider{
+		cfg:    cfg,
+		roles:  roles,
+		name:   "amazon",
+		tokens: make(map[registryKey]token),
 	}
+	p.requestToken = p.requestRegistryToken
 
-	authTokenOutput, err := p.ecrClient.GetAuthorizationToken(context.TODO(), &ecr.GetAuthorizationTokenInput{})
+	return p
+}
+
+// GetAuthKeychain returns a token for the ECR registry of the image. Tokens are cached per account and region
+// until shortly before they expire. Images of ECR Public are pulled anonymously if there is no token.
+func (p *Provider) GetAuthKeychain(image string, _ []corev1.Secret) (authn.Keychain, error) {
+	key, err := parseRegistryKey(image)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(authTokenOutput.AuthorizationData) == 0 {
-		return nil, fmt.Errorf("no authorization data received from ECR")
+	if t, ok := p.cachedToken(key); ok {
+		return t.keychain(), nil
 	}
 
-	authData := authTokenOutput.AuthorizationData[0]
+	t, err, _ := p.requests.Do(key.account+"/"+key.region, func() (any, error) {
+		// The token may have been cached by a request that has just finished.
+		if t, ok := p.cachedToken(key); ok {
+			return t, nil
+		}
 
-	if authData.AuthorizationToken == nil || *authData.AuthorizationToken == "" {
-		return nil, fmt.Errorf("authorization token is missing or empty")
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), tokenRequestTimeout)
+		defer cancel()
 
-	decodedToken, err := base64.StdEncoding.DecodeString(*authData.AuthorizationToken)
+		t, err := p.requestToken(ctx, key)
+		if err != nil {
+			if key.account != "" {
+				return nil, err
+			}
+
+			logrus.Warn("error while getting ECR Public token, falling back to anonymous access ", err)
+			t = token{anonymous: true, refreshAt: time.Now().Add(anonymousRetryInterval)}
+		}
+
+		p.lock.Lock()
+		p.tokens[key] = t
+		p.lock.Unlock()
+
+		return t, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	credentials := strings.SplitN(string(decodedToken), ":", 2)
-	if len(credentials) != 2 {
-		return nil, fmt.Errorf("invalid authorization token format")
+	return t.(token).keychain(), nil
+}
+
+func (p *Provider) cachedToken(key registryKey) (token, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	t, ok := p.tokens[key]
+
+	return t, ok && time.Now().Before(t.refreshAt)
+}
+
+func parseRegistryKey(image string) (registryKey, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return registryKey{}, err
+	}
+
+	registry := ref.Context().RegistryStr()
+	if registry == publicRegistry {
+		return registryKey{region: publicRegion}, nil
 	}
 
-	p.authToken = authn.AuthConfig{
-		Username: credentials[0],
-		Password: credentials[1],
+	match := privateRegistryRegex.FindStringSubmatch(registry)
+	if match == nil {
+		return registryKey{}, fmt.Errorf("%q is not an ECR registry", registry)
 	}
-	p.authTokenExpiry = *authData.ExpiresAt
 
-	return &customKeychain{authenticator: authn.FromConfig(p.authToken)}, nil
+	return registryKey{account: match[1], region: match[2]}, nil
 }
 
-func requestEC2Region() string {
-	ec2metadataClient := ec2metadata.New("http://169.254.169.254", 1)
-	metadata := ec2metadataClient.GetNodeMetadata()
+// requestRegistryToken requests a token in the region of the registry, with the role configured for its account if any.
+func (p *Provider) requestRegistryToken(ctx context.Context, key registryKey) (token, error) {
+	var credentials aws.CredentialsProvider
+	if roleARN, ok := p.roles[key.account]; ok {
+		stsClient := sts.NewFromConfig(p.cfg, func(o *sts.Options) { o.Region = key.region })
+		credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "k8s-image-availability-exporter"
+		}))
+	}
+
+	var (
+		encodedToken *string
+		expiresAt    *time.Time
+	)
+	if key.account == "" {
+		client := ecrpublic.NewFromConfig(p.cfg, func(o *ecrpublic.Options) {
+			o.Region = key.region
+			if credentials != nil {
+				o.Credentials = credentials
+			}
+		})
+		authTokenOutput, err := client.GetAuthorizationToken(ctx, &ecrpublic.GetAuthorizationTokenInput{})
+		if err != nil {
+			return token{}, err
+		}
+		if authTokenOutput.AuthorizationData == nil {
+			return token{}, fmt.Errorf("no authorization data received from ECR Public")
+		}
+		encodedToken, expiresAt = authTokenOutput.AuthorizationData.AuthorizationToken, authTokenOutput.AuthorizationData.ExpiresAt
+	} else {
+		client := ecr.NewFromConfig(p.cfg, func(o *ecr.Options) {
+			o.Region = key.region
+			if credentials != nil {
+				o.Credentials = credentials
+			}
+		})
+		authTokenOutput, err := client.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+		if err != nil {
+			return token{}, err
+		}
+		if len(authTokenOutput.AuthorizationData) == 0 {
+			return token{}, fmt.Errorf("no authorization data received from ECR")
+		}
+		encodedToken, expiresAt = authTokenOutput.AuthorizationData[0].AuthorizationToken, authTokenOutput.AuthorizationData[0].ExpiresAt
+	}
+
+	return newToken(encodedToken, expiresAt, time.Now())
+}
+
+// newToken decodes the "user:password" authorization token, it is refreshed shortly before it expires.
+func newToken(encodedToken *string, expiresAt *time.Time, now time.Time) (token, error) {
+	if encodedToken == nil || *encodedToken == "" {
+		return token{}, fmt.Errorf("authorization token is missing or empty")
+	}
+
+	decodedToken, err := base64.StdEncoding.DecodeString(*encodedToken)
+	if err != nil {
+		return token{}, err
+	}
+
+	credentialsParts := strings.SplitN(string(decodedToken), ":", 2)
+	if len(credentialsParts) != 2 {
+		return token{}, fmt.Errorf("invalid authorization token format")
+	}
+
+	expiry := now.Add(defaultTokenLifetime)
+	if expiresAt != nil {
+		expiry = *expiresAt
+	}
 
-	return metadata.Region
+	return token{
+		authConfig: authn.AuthConfig{
+			Username: credentialsParts[0],
+			Password: credentialsParts[1],
+		},
+		refreshAt: expiry.Add(-tokenRefreshPeriod),
+	}, nil
 }
 
 type customKeychain struct {
@@ -86,6 +249,6 @@ func (kc *customKeychain) Resolve(_ authn.Resource) (authn.Authenticator, error)
 	return kc.authenticator, nil
 }
 
-func (p Provider) GetName() string {
+func (p *Provider) GetName() string {
 	return p.name
 }
@@ -0,0 +1,117 @@
+package amazon
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRegistryKey(t *testing.T) {
+	for image, expected := range map[string]registryKey{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/image:latest":          {account: "123456789012", region: "eu-west-1"},
+		"123456789012.dkr.ecr-fips.us-east-2.amazonaws.com/image@sha256:" + hex64: {account: "123456789012", region: "us-east-2"},
+		"210987654321.dkr.ecr.cn-north-1.amazonaws.com.cn/image":                  {account: "210987654321", region: "cn-north-1"},
+		"public.ecr.aws/team/image:latest":                                        {region: publicRegion},
+	} {
+		key, err := parseRegistryKey(image)
+		require.NoError(t, err, image)
+		assert.Equal(t, expected, key, image)
+	}
+
+	_, err := parseRegistryKey("registry.io/image:latest")
+	assert.Error(t, err)
+}
+
+const hex64 = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func Test_GetAuthKeychain(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests []registryKey
+	)
+	p := &Provider{tokens: make(map[registryKey]token)}
+	p.requestToken = func(ctx context.Context, key registryKey) (token, error) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok, "token requests are bounded")
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, key)
+
+		if key.account == "" {
+			return token{}, errors.New("no credentials")
+		}
+		return token{
+			authConfig: authn.AuthConfig{Username: "AWS", Password: key.account + "/" + key.region},
+			refreshAt:  time.Now().Add(time.Hour),
+		}, nil
+	}
+
+	password := func(image string) string {
+		t.Helper()
+
+		kc, err := p.GetAuthKeychain(image, nil)
+		require.NoError(t, err)
+		ref, err := name.ParseReference(image)
+		require.NoError(t, err)
+		authenticator, err := kc.Resolve(ref.Context())
+		require.NoError(t, err)
+		config, err := authenticator.Authorization()
+		require.NoError(t, err)
+
+		return config.Password
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "123456789012/eu-west-1", password("123456789012.dkr.ecr.eu-west-1.amazonaws.com/app-a:latest"))
+			assert.Equal(t, "123456789012/us-east-1", password("123456789012.dkr.ecr.us-east-1.amazonaws.com/app-b:latest"))
+			assert.Equal(t, "210987654321/eu-west-1", password("210987654321.dkr.ecr.eu-west-1.amazonaws.com/app-c:latest"))
+		}()
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []registryKey{
+		{account: "123456789012", region: "eu-west-1"},
+		{account: "123456789012", region: "us-east-1"},
+		{account: "210987654321", region: "eu-west-1"},
+	}, requests)
+
+	t.Run("ECR Public falls back to anonymous access", func(t *testing.T) {
+		kc, err := p.GetAuthKeychain("public.ecr.aws/team/image:latest", nil)
+		require.NoError(t, err)
+		authenticator, err := kc.Resolve(name.MustParseReference("public.ecr.aws/team/image").Context())
+		require.NoError(t, err)
+		assert.Equal(t, authn.Anonymous, authenticator)
+	})
+}
+
+func Test_newToken(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	encoded := base64.StdEncoding.EncodeToString([]byte("AWS:password"))
+
+	expiresAt := now.Add(6 * time.Hour)
+	tok, err := newToken(&encoded, &expiresAt, now)
+	require.NoError(t, err)
+	assert.Equal(t, authn.AuthConfig{Username: "AWS", Password: "password"}, tok.authConfig)
+	assert.Equal(t, now.Add(5*time.Hour), tok.refreshAt)
+
+	tok, err = newToken(&encoded, nil, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(defaultTokenLifetime-tokenRefreshPeriod), tok.refreshAt, "tokens without the expiry time are cached too")
+
+	invalid := base64.StdEncoding.EncodeToString([]byte("password"))
+	_, err = newToken(&invalid, nil, now)
+	assert.Error(t, err)
+}
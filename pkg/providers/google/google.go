@@ -0,0 +1,83 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// tokenUsername is the username Artifact Registry and Container Registry accept access tokens with.
+	tokenUsername = "oauth2accesstoken"
+)
+
+// Provider gets access tokens for Artifact Registry and Container Registry from the GCE metadata server, i.e.,
+// for the service account of the node or of the Workload Identity of the exporter, or from a service account key file.
+type Provider struct {
+	name string
+	// tokenSource caches the token until it expires, it is nil if there are no credentials.
+	tokenSource oauth2.TokenSource
+}
+
+// NewProvider reads the service account key from the file if the path is set, otherwise the metadata server is used
+// when running on GCE.
+func NewProvider(serviceAccountKeyPath string) (*Provider, error) {
+	p := &Provider{name: "google"}
+
+	switch {
+	case serviceAccountKeyPath != "":
+		data, err := os.ReadFile(serviceAccountKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials, err := google.CredentialsFromJSONWithType(context.Background(), data, google.ServiceAccount, cloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", serviceAccountKeyPath, err)
+		}
+		p.tokenSource = credentials.TokenSource
+	case metadata.OnGCE():
+		p.tokenSource = google.ComputeTokenSource("", cloudPlatformScope)
+	}
+
+	return p, nil
+}
+
+// GetAuthKeychain returns the access token, or a keychain that resolves to anonymous access if there are no
+// credentials or the token cannot be fetched, so that public images and pull secrets keep working.
+func (p *Provider) GetAuthKeychain(_ string, _ []corev1.Secret) (authn.Keychain, error) {
+	if p.tokenSource == nil {
+		return authn.NewMultiKeychain(), nil
+	}
+
+	token, err := p.tokenSource.Token()
+	if err != nil {
+		logrus.Warn("error while getting google access token ", err)
+		return authn.NewMultiKeychain(), nil
+	}
+
+	return &customKeychain{authenticator: authn.FromConfig(authn.AuthConfig{
+		Username: tokenUsername,
+		Password: token.AccessToken,
+	})}, nil
+}
+
+type customKeychain struct {
+	authenticator authn.Authenticator
+}
+
+func (kc *customKeychain) Resolve(_ authn.Resource) (authn.Authenticator, error) {
+	return kc.authenticator, nil
+}
+
+func (p *Provider) GetName() string {
+	return p.name
+}
@@ -0,0 +1,55 @@
+package google
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("metadata server unavailable")
+}
+
+func Test_GetAuthKeychain(t *testing.T) {
+	resource := name.MustParseReference("europe-docker.pkg.dev/project/repo/image").Context()
+
+	for _, tc := range []struct {
+		name          string
+		tokenSource   oauth2.TokenSource
+		authorization *authn.AuthConfig
+	}{
+		{
+			name:          "token",
+			tokenSource:   oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ya29.token"}),
+			authorization: &authn.AuthConfig{Username: tokenUsername, Password: "ya29.token"},
+		},
+		{
+			name:          "no credentials",
+			authorization: &authn.AuthConfig{},
+		},
+		{
+			name:          "token error",
+			tokenSource:   failingTokenSource{},
+			authorization: &authn.AuthConfig{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Provider{name: "google", tokenSource: tc.tokenSource}
+
+			kc, err := p.GetAuthKeychain(resource.String(), nil)
+			require.NoError(t, err)
+			authenticator, err := kc.Resolve(resource)
+			require.NoError(t, err)
+			authorization, err := authenticator.Authorization()
+			require.NoError(t, err)
+			assert.Equal(t, tc.authorization, authorization)
+		})
+	}
+}
@@ -13,14 +13,12 @@ import (
 )
 
 type Provider struct {
-	pullSecretsGetter func(image string) []corev1.Secret
-	name              string
+	name string
 }
 
-func NewProvider(pullSecretsGetter func(image string) []corev1.Secret) *Provider {
+func NewProvider() *Provider {
 	return &Provider{
-		pullSecretsGetter: pullSecretsGetter,
-		name:              "k8s",
+		name: "k8s",
 	}
 }
 
@@ -118,9 +116,8 @@ func updateDockerRegistryAuths(dockerConfig map[string]json.RawMessage) error {
 	return nil
 }
 
-func (p Provider) GetAuthKeychain(registry string) (authn.Keychain, error) {
-	dereferencedPullSecrets := p.pullSecretsGetter(registry)
-	correctedSecrets, err := p.correctDockerRegistry(dereferencedPullSecrets)
+func (p Provider) GetAuthKeychain(_ string, pullSecrets []corev1.Secret) (authn.Keychain, error) {
+	correctedSecrets, err := p.correctDockerRegistry(pullSecrets)
 	if err != nil {
 		return nil, err
 	}
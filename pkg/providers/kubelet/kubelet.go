@@ -0,0 +1,401 @@
+package kubelet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	credentialProviderRequestKind  = "CredentialProviderRequest"
+	credentialProviderResponseKind = "CredentialProviderResponse"
+
+	cacheKeyTypeImage    = "Image"
+	cacheKeyTypeRegistry = "Registry"
+	cacheKeyTypeGlobal   = "Global"
+
+	// execTimeout is the time a plugin has to respond, the same as kubelet gives it.
+	execTimeout = time.Minute
+)
+
+// credentialProviderConfig is the kubelet CredentialProviderConfig, see
+// https://kubernetes.io/docs/reference/config-api/kubelet-config.v1/#kubelet-config-k8s-io-v1-CredentialProviderConfig.
+// Fields the exporter has no use for are ignored.
+type credentialProviderConfig struct {
+	Kind      string                   `json:"kind"`
+	Providers []credentialProviderSpec `json:"providers"`
+}
+
+type credentialProviderSpec struct {
+	Name                 string   `json:"name"`
+	MatchImages          []string `json:"matchImages"`
+	DefaultCacheDuration string   `json:"defaultCacheDuration"`
+	APIVersion           string   `json:"apiVersion"`
+	Args                 []string `json:"args"`
+	Env                  []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"env"`
+}
+
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type credentialProviderResponse struct {
+	APIVersion    string                      `json:"apiVersion"`
+	Kind          string                      `json:"kind"`
+	CacheKeyType  string                      `json:"cacheKeyType"`
+	CacheDuration *string                     `json:"cacheDuration,omitempty"`
+	Auth          map[string]authn.AuthConfig `json:"auth"`
+}
+
+// Provider gets credentials from kubelet credential provider plugins, e.g., ecr-credential-provider,
+// acr-credential-provider or in-house ones. Plugins are executed in the exporter container, so they see
+// its environment and cloud identity rather than the node's.
+type Provider struct {
+	name    string
+	plugins []*plugin
+}
+
+type plugin struct {
+	name                 string
+	path                 string
+	args                 []string
+	env                  []string
+	apiVersion           string
+	matchImages          []string
+	defaultCacheDuration time.Duration
+
+	lock  sync.Mutex
+	cache map[string]cacheEntry
+	// execs dedupes concurrent executions for the same image, the lock is not held while the plugin runs.
+	execs singleflight.Group
+}
+
+type cacheEntry struct {
+	auth      map[string]authn.AuthConfig
+	expiresAt time.Time
+}
+
+// NewProvider reads the CredentialProviderConfig file, plugin binaries are looked up in binDir.
+func NewProvider(configPath, binDir string) (*Provider, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var config credentialProviderConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", configPath, err)
+	}
+	if config.Kind != "CredentialProviderConfig" {
+		return nil, fmt.Errorf("%q: unexpected kind %q, expected CredentialProviderConfig", configPath, config.Kind)
+	}
+
+	p := &Provider{name: "kubelet"}
+	for _, spec := range config.Providers {
+		if spec.Name == "" || strings.ContainsAny(spec.Name, `/\`) {
+			return nil, fmt.Errorf("invalid credential provider name %q", spec.Name)
+		}
+		if len(spec.MatchImages) == 0 {
+			return nil, fmt.Errorf("credential provider %q: matchImages is required", spec.Name)
+		}
+		if spec.APIVersion == "" {
+			return nil, fmt.Errorf("credential provider %q: apiVersion is required", spec.Name)
+		}
+		for _, matchImage := range spec.MatchImages {
+			if _, err := parseSchemelessURL(matchImage); err != nil {
+				return nil, fmt.Errorf("credential provider %q: invalid match image %q: %w", spec.Name, matchImage, err)
+			}
+		}
+
+		var defaultCacheDuration time.Duration
+		if spec.DefaultCacheDuration != "" {
+			defaultCacheDuration, err = time.ParseDuration(spec.DefaultCacheDuration)
+			if err != nil {
+				return nil, fmt.Errorf("credential provider %q: invalid defaultCacheDuration: %w", spec.Name, err)
+			}
+		}
+
+		pluginPath := filepath.Join(binDir, spec.Name)
+		if _, err := os.Stat(pluginPath); err != nil {
+			return nil, fmt.Errorf("credential provider %q: %w", spec.Name, err)
+		}
+
+		env := os.Environ()
+		for _, e := range spec.Env {
+			env = append(env, e.Name+"="+e.Value)
+		}
+
+		p.plugins = append(p.plugins, &plugin{
+			name:                 spec.Name,
+			path:                 pluginPath,
+			args:                 spec.Args,
+			env:                  env,
+			apiVersion:           spec.APIVersion,
+			matchImages:          spec.MatchImages,
+			defaultCacheDuration: defaultCacheDuration,
+			cache:                make(map[string]cacheEntry),
+		})
+	}
+
+	return p, nil
+}
+
+// MatchesImage reports whether any plugin is configured for the image.
+func (p *Provider) MatchesImage(image string) bool {
+	repository, err := repositoryName(image)
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(p.plugins, func(pl *plugin) bool { return pl.matches(repository) })
+}
+
+// GetAuthKeychain returns the credentials of all plugins matching the image. Like kubelet, a failing plugin
+// is skipped, so that the image is still checked with the other credentials.
+func (p *Provider) GetAuthKeychain(image string, _ []corev1.Secret) (authn.Keychain, error) {
+	repository, err := repositoryName(image)
+	if err != nil {
+		return nil, err
+	}
+
+	kc := &keychain{auth: make(map[string]authn.AuthConfig)}
+	for _, pl := range p.plugins {
+		if !pl.matches(repository) {
+			continue
+		}
+
+		auth, err := pl.provide(repository)
+		if err != nil {
+			logrus.WithField("credential_provider", pl.name).Warnf("error while getting credentials for %q: %v", repository, err)
+			continue
+		}
+		for key, config := range auth {
+			if _, ok := kc.auth[key]; !ok {
+				kc.auth[key] = config
+			}
+		}
+	}
+
+	return kc, nil
+}
+
+func (p *Provider) GetName() string {
+	return p.name
+}
+
+func (pl *plugin) matches(repository string) bool {
+	return slices.ContainsFunc(pl.matchImages, func(matchImage string) bool { return urlsMatch(matchImage, repository) })
+}
+
+// provide returns cached credentials for the image, its registry or any image, in that order, and executes
+// the plugin if there are none.
+func (pl *plugin) provide(repository string) (map[string]authn.AuthConfig, error) {
+	registry, _, _ := strings.Cut(repository, "/")
+
+	if auth, ok := pl.cached(repository, registry); ok {
+		return auth, nil
+	}
+
+	auth, err, _ := pl.execs.Do(cacheKey(cacheKeyTypeImage, repository), func() (any, error) {
+		// The credentials may have been cached by an execution that has just finished.
+		if auth, ok := pl.cached(repository, registry); ok {
+			return auth, nil
+		}
+
+		return pl.execAndCache(repository, registry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.(map[string]authn.AuthConfig), nil
+}
+
+func (pl *plugin) cached(repository, registry string) (map[string]authn.AuthConfig, bool) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	for _, key := range []string{cacheKey(cacheKeyTypeImage, repository), cacheKey(cacheKeyTypeRegistry, registry), cacheKey(cacheKeyTypeGlobal, "")} {
+		entry, ok := pl.cache[key]
+		if !ok {
+			continue
+		}
+		if time.Now().Before(entry.expiresAt) {
+			return entry.auth, true
+		}
+		delete(pl.cache, key)
+	}
+
+	return nil, false
+}
+
+func (pl *plugin) execAndCache(repository, registry string) (map[string]authn.AuthConfig, error) {
+	response, err := pl.exec(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDuration := pl.defaultCacheDuration
+	if response.CacheDuration != nil {
+		cacheDuration, err = time.ParseDuration(*response.CacheDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cacheDuration in the response: %w", err)
+		}
+	}
+
+	var key string
+	switch response.CacheKeyType {
+	case cacheKeyTypeImage:
+		key = cacheKey(cacheKeyTypeImage, repository)
+	case cacheKeyTypeRegistry:
+		key = cacheKey(cacheKeyTypeRegistry, registry)
+	case cacheKeyTypeGlobal:
+		key = cacheKey(cacheKeyTypeGlobal, "")
+	default:
+		return nil, fmt.Errorf("invalid cacheKeyType %q in the response", response.CacheKeyType)
+	}
+	if cacheDuration > 0 {
+		pl.lock.Lock()
+		pl.cache[key] = cacheEntry{auth: response.Auth, expiresAt: time.Now().Add(cacheDuration)}
+		pl.lock.Unlock()
+	}
+
+	return response.Auth, nil
+}
+
+func (pl *plugin) exec(repository string) (*credentialProviderResponse, error) {
+	request, err := json.Marshal(credentialProviderRequest{
+		APIVersion: pl.apiVersion,
+		Kind:       credentialProviderRequestKind,
+		Image:      repository,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pl.path, pl.args...)
+	cmd.Env = pl.env
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("executing %s: %w, stderr: %s", pl.path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response credentialProviderResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("decoding the response: %w", err)
+	}
+	if response.Kind != credentialProviderResponseKind || response.APIVersion != pl.apiVersion {
+		return nil, fmt.Errorf("unexpected response %s/%s, expected %s/%s", response.APIVersion, response.Kind, pl.apiVersion, credentialProviderResponseKind)
+	}
+
+	return &response, nil
+}
+
+func cacheKey(cacheKeyType, value string) string {
+	return cacheKeyType + "/" + value
+}
+
+// repositoryName returns the repository of the image the way kubelet passes it to plugins, without a tag or digest.
+func repositoryName(image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Context().Name(), nil
+}
+
+// keychain resolves the credentials of the most specific key matching the repository.
+type keychain struct {
+	auth map[string]authn.AuthConfig
+}
+
+func (kc *keychain) Resolve(resource authn.Resource) (authn.Authenticator, error) {
+	keys := make([]string, 0, len(kc.auth))
+	for key := range kc.auth {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, key := range keys {
+		if urlsMatch(key, resource.String()) {
+			return authn.FromConfig(kc.auth[key]), nil
+		}
+	}
+
+	return authn.Anonymous, nil
+}
+
+func parseSchemelessURL(s string) (*url.URL, error) {
+	u, err := url.Parse("https://" + s)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = ""
+
+	return u, nil
+}
+
+// urlsMatch matches the target against the glob the way kubelet does: host parts are matched one by one
+// with wildcards, e.g., "*.registry.io", ports have to be equal and the glob path has to be a prefix of the target path.
+func urlsMatch(glob, target string) bool {
+	globURL, err := parseSchemelessURL(glob)
+	if err != nil {
+		return false
+	}
+	targetURL, err := parseSchemelessURL(target)
+	if err != nil {
+		return false
+	}
+
+	if globURL.Port() != targetURL.Port() {
+		return false
+	}
+
+	globParts := strings.Split(globURL.Hostname(), ".")
+	targetParts := strings.Split(targetURL.Hostname(), ".")
+	if len(globParts) != len(targetParts) {
+		return false
+	}
+	for i, globPart := range globParts {
+		if matched, err := path.Match(globPart, targetParts[i]); err != nil || !matched {
+			return false
+		}
+	}
+
+	return strings.HasPrefix(targetURL.Path, globURL.Path)
+}
@@ -0,0 +1,169 @@
+package kubelet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_urlsMatch(t *testing.T) {
+	for _, tc := range []struct {
+		glob, target string
+		match        bool
+	}{
+		{"registry.io", "registry.io/repo/image", true},
+		{"*.registry.io", "eu.registry.io/image", true},
+		{"*.registry.io", "registry.io/image", false},
+		{"*.*.registry.io", "a.b.registry.io/image", true},
+		{"*.dkr.ecr.*.amazonaws.com", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/image", true},
+		{"registry.io:5000", "registry.io/image", false},
+		{"registry.io:5000", "registry.io:5000/image", true},
+		{"registry.io/team", "registry.io/team/image", true},
+		{"registry.io/team", "registry.io/other/image", false},
+	} {
+		assert.Equal(t, tc.match, urlsMatch(tc.glob, tc.target), "%s matching %s", tc.glob, tc.target)
+	}
+}
+
+// writePlugin writes a plugin that responds with the response and counts its invocations in the "calls" file.
+func writePlugin(t *testing.T, binDir, pluginName, response string) {
+	t.Helper()
+
+	script := "#!/bin/sh\ncat > " + filepath.Join(binDir, pluginName+".request") + "\necho x >> " + filepath.Join(binDir, pluginName+".calls") + "\ncat <<'EOF'\n" + response + "\nEOF\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, pluginName), []byte(script), 0o755))
+}
+
+func pluginCalls(t *testing.T, binDir, pluginName string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(binDir, pluginName+".calls"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+
+	return strings.Count(string(data), "x")
+}
+
+func Test_Provider(t *testing.T) {
+	binDir := t.TempDir()
+	writePlugin(t, binDir, "registry-plugin", `{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Registry",
+  "cacheDuration": "1h",
+  "auth": {
+    "*.registry.io": {"username": "user", "password": "wildcard"},
+    "eu.registry.io/team": {"username": "user", "password": "team"}
+  }
+}`)
+	writePlugin(t, binDir, "uncached-plugin", `{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Image",
+  "auth": {"other.io": {"username": "other", "password": "secret"}}
+}`)
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: registry-plugin
+  matchImages: ["*.registry.io"]
+  defaultCacheDuration: 10m
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+- name: uncached-plugin
+  matchImages: ["other.io"]
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+`), 0o644))
+
+	p, err := NewProvider(configPath, binDir)
+	require.NoError(t, err)
+
+	assert.True(t, p.MatchesImage("eu.registry.io/team/image:latest"))
+	assert.False(t, p.MatchesImage("registry.io/team/image:latest"))
+
+	resolve := func(image string) authn.AuthConfig {
+		t.Helper()
+
+		kc, err := p.GetAuthKeychain(image, nil)
+		require.NoError(t, err)
+		ref, err := name.ParseReference(image)
+		require.NoError(t, err)
+		authenticator, err := kc.Resolve(ref.Context())
+		require.NoError(t, err)
+		config, err := authenticator.Authorization()
+		require.NoError(t, err)
+
+		return *config
+	}
+
+	t.Run("most specific key", func(t *testing.T) {
+		assert.Equal(t, "team", resolve("eu.registry.io/team/image:latest").Password)
+		assert.Equal(t, "wildcard", resolve("eu.registry.io/other/image:latest").Password)
+
+		request, err := os.ReadFile(filepath.Join(binDir, "registry-plugin.request"))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"eu.registry.io/team/image"}`, string(request))
+	})
+
+	t.Run("cached per registry", func(t *testing.T) {
+		assert.Equal(t, "wildcard", resolve("eu.registry.io/another/image:latest").Password)
+		assert.Equal(t, 1, pluginCalls(t, binDir, "registry-plugin"))
+
+		resolve("us.registry.io/image:latest")
+		assert.Equal(t, 2, pluginCalls(t, binDir, "registry-plugin"))
+	})
+
+	t.Run("not cached without cache duration", func(t *testing.T) {
+		assert.Equal(t, "secret", resolve("other.io/image:latest").Password)
+		assert.Equal(t, "secret", resolve("other.io/image:latest").Password)
+		assert.Equal(t, 2, pluginCalls(t, binDir, "uncached-plugin"))
+	})
+}
+
+func Test_Provider_concurrent(t *testing.T) {
+	binDir := t.TempDir()
+	writePlugin(t, binDir, "plugin", `{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Image",
+  "cacheDuration": "1h",
+  "auth": {"registry.io": {"username": "user", "password": "secret"}}
+}`)
+	// The slow plugin gives concurrent calls the time to pile up.
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "slow-plugin"), []byte("#!/bin/sh\nsleep 0.2\nexec "+filepath.Join(binDir, "plugin")+"\n"), 0o755))
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: slow-plugin
+  matchImages: ["registry.io"]
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+`), 0o644))
+
+	p, err := NewProvider(configPath, binDir)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := p.GetAuthKeychain("registry.io/image:latest", nil)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, pluginCalls(t, binDir, "plugin"))
+}
@@ -5,11 +5,19 @@ import (
 	"regexp"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/sirupsen/logrus"
 )
 
 type Provider interface {
 	GetName() string
-	GetAuthKeychain(registry string) (authn.Keychain, error)
+	// GetAuthKeychain returns the keychain to check the image with, pullSecrets are the secrets of the workloads
+	// the check is performed for.
+	GetAuthKeychain(image string, pullSecrets []corev1.Secret) (authn.Keychain, error)
+}
+
+// ImageMatcher is implemented by providers that are configured for particular images rather than registry hosts.
+type ImageMatcher interface {
+	MatchesImage(image string) bool
 }
 
 type ProviderRegistry map[string]Provider
@@ -27,14 +35,46 @@ func NewProviderChain(providers ...Provider) ProviderRegistry {
 type ImagePullSecretsFunc func(image string) []corev1.Secret
 
 var (
-	amazonURLRegex = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/([^:]+):(.+)$`)
+	amazonURLRegex = regexp.MustCompile(`^(?:\d{12}\.dkr\.ecr(?:-fips)?\.[a-z0-9-]+\.amazonaws\.com(?:\.cn)?|public\.ecr\.aws)/`)
+	googleURLRegex = regexp.MustCompile(`^(?:[a-z0-9-]+-docker\.pkg\.dev|(?:[a-z]+\.)?gcr\.io)/`)
 )
 
-func (p ProviderRegistry) GetAuthKeychain(registry string) (authn.Keychain, error) {
+// GetAuthKeychain returns the keychain of the provider serving the image. Credentials of kubelet credential provider
+// plugins, ECR tokens and Google access tokens are combined with the pull secrets, which take precedence, as kubelet does.
+// In the strict mode, ECR and Google credentials of the exporter itself are left out, kubelet would not use them.
+func (p ProviderRegistry) GetAuthKeychain(image string, pullSecrets []corev1.Secret, strict bool) (authn.Keychain, error) {
+	if kubelet, ok := p["kubelet"].(ImageMatcher); ok && kubelet.MatchesImage(image) {
+		return p.withPullSecrets(p["kubelet"], image, pullSecrets)
+	}
+
 	switch {
-	case amazonURLRegex.MatchString(registry):
-		return p["amazon"].GetAuthKeychain(registry)
+	case strict:
+		return p["k8s"].GetAuthKeychain(image, pullSecrets)
+	case amazonURLRegex.MatchString(image):
+		return p.withPullSecrets(p["amazon"], image, pullSecrets)
+	case googleURLRegex.MatchString(image):
+		return p.withPullSecrets(p["google"], image, pullSecrets)
 	default:
-		return p["k8s"].GetAuthKeychain(registry)
+		return p["k8s"].GetAuthKeychain(image, pullSecrets)
+	}
+}
+
+// withPullSecrets combines the keychain of the provider with the pull secrets. If the provider fails, e.g., an ECR token
+// cannot be requested, the image is still checked with the pull secrets.
+func (p ProviderRegistry) withPullSecrets(provider Provider, image string, pullSecrets []corev1.Secret) (authn.Keychain, error) {
+	secretsKeychain, err := p["k8s"].GetAuthKeychain(image, pullSecrets)
+	if err != nil {
+		return nil, err
 	}
+	providerKeychain, err := provider.GetAuthKeychain(image, pullSecrets)
+	if err != nil {
+		if len(pullSecrets) == 0 {
+			return nil, err
+		}
+
+		logrus.WithField("provider", provider.GetName()).Warnf("error while getting credentials for %q, checking with pull secrets only: %v", image, err)
+		return secretsKeychain, nil
+	}
+
+	return authn.NewMultiKeychain(secretsKeychain, providerKeychain), nil
 }
@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeProvider authenticates as its name, or anonymously if there are no pull secrets and secretsOnly is set.
+// A failing provider returns an error instead.
+type fakeProvider struct {
+	name        string
+	secretsOnly bool
+	failing     bool
+}
+
+func (p fakeProvider) GetName() string { return p.name }
+
+func (p fakeProvider) GetAuthKeychain(_ string, pullSecrets []corev1.Secret) (authn.Keychain, error) {
+	if p.failing {
+		return nil, errors.New("no credentials")
+	}
+	if p.secretsOnly && len(pullSecrets) == 0 {
+		return authn.NewMultiKeychain(), nil
+	}
+
+	return fakeKeychain(p.name), nil
+}
+
+type fakeKeychain string
+
+func (kc fakeKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return &authn.Basic{Username: string(kc)}, nil
+}
+
+func Test_GetAuthKeychain(t *testing.T) {
+	registry := NewProviderChain(
+		fakeProvider{name: "amazon"},
+		fakeProvider{name: "google"},
+		fakeProvider{name: "k8s", secretsOnly: true},
+	)
+
+	username := func(image string, pullSecrets []corev1.Secret) string {
+		t.Helper()
+
+		kc, err := registry.GetAuthKeychain(image, pullSecrets, false)
+		require.NoError(t, err)
+		authenticator, err := kc.Resolve(name.MustParseReference("registry.io/image").Context())
+		require.NoError(t, err)
+		authorization, err := authenticator.Authorization()
+		require.NoError(t, err)
+
+		return authorization.Username
+	}
+
+	secrets := []corev1.Secret{{}}
+	for image, expected := range map[string]string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/image:latest":     "amazon",
+		"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/image:latest": "amazon",
+		"public.ecr.aws/team/image:latest":                              "amazon",
+		"europe-west1-docker.pkg.dev/project/repo/image:latest":         "google",
+		"gcr.io/project/image:latest":                                   "google",
+		"eu.gcr.io/project/image:latest":                                "google",
+		"registry.io/image:latest":                                      "",
+		"docker.io/library/nginx:latest":                                "",
+	} {
+		assert.Equal(t, expected, username(image, nil), image)
+	}
+
+	assert.Equal(t, "k8s", username("gcr.io/project/image:latest", secrets), "pull secrets take precedence")
+	assert.Equal(t, "k8s", username("123456789012.dkr.ecr.eu-west-1.amazonaws.com/image:latest", secrets), "pull secrets take precedence")
+	assert.Equal(t, "k8s", username("public.ecr.aws/team/image:latest", secrets), "pull secrets take precedence")
+
+	t.Run("failing provider", func(t *testing.T) {
+		registry := NewProviderChain(
+			fakeProvider{name: "amazon", failing: true},
+			fakeProvider{name: "k8s", secretsOnly: true},
+		)
+
+		_, err := registry.GetAuthKeychain("123456789012.dkr.ecr.eu-west-1.amazonaws.com/image:latest", nil, false)
+		require.Error(t, err)
+
+		kc, err := registry.GetAuthKeychain("123456789012.dkr.ecr.eu-west-1.amazonaws.com/image:latest", secrets, false)
+		require.NoError(t, err)
+		authenticator, err := kc.Resolve(name.MustParseReference("registry.io/image").Context())
+		require.NoError(t, err)
+		authorization, err := authenticator.Authorization()
+		require.NoError(t, err)
+		assert.Equal(t, "k8s", authorization.Username, "pull secrets are used if the provider fails")
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		registry := NewProviderChain(
+			fakeProvider{name: "amazon"},
+			fakeProvider{name: "google"},
+			fakeProvider{name: "k8s", secretsOnly: true},
+		)
+
+		for _, image := range []string{
+			"123456789012.dkr.ecr.eu-west-1.amazonaws.com/image:latest",
+			"europe-west1-docker.pkg.dev/project/repo/image:latest",
+		} {
+			kc, err := registry.GetAuthKeychain(image, nil, true)
+			require.NoError(t, err)
+			authenticator, err := kc.Resolve(name.MustParseReference("registry.io/image").Context())
+			require.NoError(t, err)
+			assert.Equal(t, authn.Anonymous, authenticator, "credentials of the exporter are not used")
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -8,7 +9,9 @@ import (
 	"fmt"
 	"github.com/flant/k8s-image-availability-exporter/pkg/providers"
 	"github.com/flant/k8s-image-availability-exporter/pkg/providers/amazon"
+	"github.com/flant/k8s-image-availability-exporter/pkg/providers/google"
 	"github.com/flant/k8s-image-availability-exporter/pkg/providers/k8s"
+	"github.com/flant/k8s-image-availability-exporter/pkg/providers/kubelet"
 	"github.com/flant/k8s-image-availability-exporter/pkg/version"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
@@ -17,21 +20,30 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/sirupsen/logrus"
 
+	corev1 "k8s.io/api/core/v1"
 	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	appsv1informers "k8s.io/client-go/informers/apps/v1"
 	batchv1informers "k8s.io/client-go/informers/batch/v1"
 	corev1informers "k8s.io/client-go/informers/core/v1"
 
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 
 	"k8s.io/client-go/kubernetes"
@@ -39,10 +51,8 @@ import (
 	"github.com/flant/k8s-image-availability-exporter/pkg/store"
 )
 
-const (
-	failedCheckBatchSize = 20
-	checkBatchSize       = 50
-)
+// controllerResyncPeriod is the period controllers are reconciled at, e.g., to pick up changes of namespace labels.
+const controllerResyncPeriod = time.Minute
 
 type registryCheckerConfig struct {
 	defaultRegistry string
@@ -61,23 +71,47 @@ type Checker struct {
 	cronJobsInformer       batchv1informers.CronJobInformer
 	secretsInformer        corev1informers.SecretInformer
 
+	jobsInformer                   batchv1informers.JobInformer
+	replicaSetsInformer            appsv1informers.ReplicaSetInformer
+	replicationControllersInformer corev1informers.ReplicationControllerInformer
+	podsInformer                   corev1informers.PodInformer
+
 	controllerIndexers ControllerIndexers
 
 	ignoredImagesRegex []regexp.Regexp
 	allowedImagesRegex []regexp.Regexp
 
 	registryTransport http.RoundTripper
+	retryAfter        *retryAfterTransport
 
-	kubeClient *kubernetes.Clientset
+	kubeClient kubernetes.Interface
 
 	config registryCheckerConfig
 
 	providerRegistry providers.ProviderRegistry
+
+	checkPlatforms bool
+	checkPulls     bool
+	deepCheck      deepCheckSelector
+	blobCache      *blobCache
+	// signatures looks up image signatures, nil disables the check.
+	signatures *signatureVerifier
+	// requiredArtifactTypes are artifact types that referrers of each image must have.
+	requiredArtifactTypes []string
+	// metadata fetches metadata of images, nil disables it.
+	metadata *metadataCache
+
+	strictCredentials strictCredentialsSelector
+
+	// immediateChecks holds new images and images of changed controllers that are checked out of schedule.
+	immediateChecks        workqueue.TypedInterface[store.ImageKey]
+	immediateChecksLimiter *rate.Limiter
+	synced                 atomic.Bool
 }
 
 func NewChecker(
 	stopCh <-chan struct{},
-	kubeClient *kubernetes.Clientset,
+	kubeClient kubernetes.Interface,
 	skipVerify bool,
 	plainHTTP bool,
 	caPths []string,
@@ -87,8 +121,34 @@ func NewChecker(
 	defaultRegistry string,
 	namespaceLabel string,
 	mirrorsMap map[string]string,
+	dynamicClient dynamic.Interface,
+	customResources []CustomResourceConfig,
+	rollbackRevisions int,
+	checkWorkers int,
+	maxInFlightPerRegistry int,
+	checkInterval time.Duration,
+	maxCheckInterval time.Duration,
+	maxFailureBackoff time.Duration,
+	immediateChecksPerSecond float64,
+	immediateChecksBurst int,
+	checkPlatforms bool,
+	deepCheckRegistries []string,
+	deepCheckImages []regexp.Regexp,
+	checkPulls bool,
+	checkSignatures bool,
+	signaturePublicKeyPaths []string,
+	requiredArtifactTypes []string,
+	imageMetadata bool,
+	metadataAnnotations []string,
+	strictCredentials bool,
+	strictCredentialsRegistries []string,
+	credentialProviderConfig string,
+	credentialProviderBinDir string,
+	ecrAssumeRoles map[string]string,
+	googleServiceAccountKeyPath string,
 ) *Checker {
 	informerFactory := informers.NewSharedInformerFactory(kubeClient, time.Hour)
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Hour)
 
 	customTransport := http.DefaultTransport.(*http.Transport).Clone()
 	if skipVerify {
@@ -110,7 +170,8 @@ func NewChecker(
 		customTransport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
 	}
 
-	roundTripper := transport.NewUserAgent(customTransport, fmt.Sprintf("k8s-image-availability-exporter/%s", version.Version))
+	retryAfter := newRetryAfterTransport(customTransport)
+	roundTripper := transport.NewUserAgent(retryAfter, fmt.Sprintf("k8s-image-availability-exporter/%s", version.Version))
 
 	rc := &Checker{
 		serviceAccountInformer: informerFactory.Core().V1().ServiceAccounts(),
@@ -121,13 +182,30 @@ func NewChecker(
 		cronJobsInformer:       informerFactory.Batch().V1().CronJobs(),
 		secretsInformer:        informerFactory.Core().V1().Secrets(),
 
+		jobsInformer:                   informerFactory.Batch().V1().Jobs(),
+		replicaSetsInformer:            informerFactory.Apps().V1().ReplicaSets(),
+		replicationControllersInformer: informerFactory.Core().V1().ReplicationControllers(),
+		podsInformer:                   informerFactory.Core().V1().Pods(),
+
 		ignoredImagesRegex: ignoredImages,
 		allowedImagesRegex: allowedImages,
 
+		checkPlatforms: checkPlatforms,
+		checkPulls:     checkPulls,
+		deepCheck:      deepCheckSelector{registries: deepCheckRegistries, images: deepCheckImages},
+		blobCache:      newBlobCache(verifiedBlobTTL),
+
+		requiredArtifactTypes: requiredArtifactTypes,
+		strictCredentials:     strictCredentialsSelector{all: strictCredentials, registries: strictCredentialsRegistries},
+
 		registryTransport: roundTripper,
+		retryAfter:        retryAfter,
 
 		kubeClient: kubeClient,
 
+		immediateChecks:        workqueue.NewTyped[store.ImageKey](),
+		immediateChecksLimiter: rate.NewLimiter(rate.Limit(immediateChecksPerSecond), immediateChecksBurst),
+
 		config: registryCheckerConfig{
 			defaultRegistry: defaultRegistry,
 			plainHTTP:       plainHTTP,
@@ -135,7 +213,15 @@ func NewChecker(
 		},
 	}
 
-	rc.imageStore = store.NewImageStore(rc.Check, checkBatchSize, failedCheckBatchSize)
+	rc.imageStore = store.NewImageStore(
+		rc.Check,
+		rc.RegistryHost,
+		checkWorkers,
+		maxInFlightPerRegistry,
+		checkInterval,
+		maxCheckInterval,
+		maxFailureBackoff,
+	)
 
 	err := rc.namespacesInformer.Informer().AddIndexers(namespaceIndexers(namespaceLabel))
 	if err != nil {
@@ -148,89 +234,55 @@ func NewChecker(
 	}
 	rc.controllerIndexers.serviceAccountIndexer = rc.serviceAccountInformer.Informer().GetIndexer()
 
-	_, _ = rc.deploymentsInformer.Informer().AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-		UpdateFunc: func(_, newObj interface{}) {
-			rc.reconcile(newObj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-	}, time.Minute)
-	err = rc.deploymentsInformer.Informer().AddIndexers(imageIndexers)
-	if err != nil {
-		panic(err)
-	}
-	err = rc.deploymentsInformer.Informer().SetTransform(getImagesFromDeployment)
-	if err != nil {
-		panic(err)
-	}
-	rc.controllerIndexers.deploymentIndexer = rc.deploymentsInformer.Informer().GetIndexer()
+	// Workloads of namespaces missing from the cache are skipped, and workloads are checked with the pull secrets
+	// of their service accounts, so both are synced before any workload.
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
 
-	_, _ = rc.statefulSetsInformer.Informer().AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-		UpdateFunc: func(_, newObj interface{}) {
-			rc.reconcile(newObj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-	}, time.Minute)
-	err = rc.statefulSetsInformer.Informer().AddIndexers(imageIndexers)
+	rc.controllerIndexers.deploymentIndexer = rc.setupControllerInformer(rc.deploymentsInformer.Informer(), getImagesFromDeployment, controllerResyncPeriod)
+	rc.controllerIndexers.statefulSetIndexer = rc.setupControllerInformer(rc.statefulSetsInformer.Informer(), getImagesFromStatefulSet, controllerResyncPeriod)
+	rc.controllerIndexers.daemonSetIndexer = rc.setupControllerInformer(rc.daemonSetsInformer.Informer(), getImagesFromDaemonSet, controllerResyncPeriod)
+	rc.controllerIndexers.cronJobIndexer = rc.setupControllerInformer(rc.cronJobsInformer.Informer(), getImagesFromCronJob, controllerResyncPeriod)
+	rc.controllerIndexers.jobIndexer = rc.setupControllerInformer(rc.jobsInformer.Informer(), getImagesFromJob, controllerResyncPeriod)
+	rc.controllerIndexers.replicaSetIndexer = rc.setupControllerInformer(rc.replicaSetsInformer.Informer(), getImagesFromReplicaSet, controllerResyncPeriod)
+	err = rc.replicaSetsInformer.Informer().AddIndexers(ownerIndexers)
 	if err != nil {
 		panic(err)
 	}
-	err = rc.statefulSetsInformer.Informer().SetTransform(getImagesFromStatefulSet)
-	if err != nil {
-		panic(err)
+	rc.controllerIndexers.replicationControllerIndexer = rc.setupControllerInformer(rc.replicationControllersInformer.Informer(), getImagesFromReplicationController, controllerResyncPeriod)
+	rc.controllerIndexers.podIndexer = rc.setupControllerInformer(rc.podsInformer.Informer(), getImagesFromPod, 0)
+	rc.setupCustomResourceInformers(dynamicInformerFactory, kubeClient.Discovery(), customResources)
+
+	if rollbackRevisions > 0 {
+		controllerRevisionsInformer := informerFactory.Apps().V1().ControllerRevisions().Informer()
+		rc.controllerIndexers.controllerRevisionIndexer = rc.setupControllerInformer(controllerRevisionsInformer, getImagesFromControllerRevision, controllerResyncPeriod)
+		err = controllerRevisionsInformer.AddIndexers(ownerIndexers)
+		if err != nil {
+			panic(err)
+		}
 	}
-	rc.controllerIndexers.statefulSetIndexer = rc.statefulSetsInformer.Informer().GetIndexer()
+	rc.controllerIndexers.rollbackRevisions = rollbackRevisions
 
-	_, _ = rc.daemonSetsInformer.Informer().AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-		UpdateFunc: func(_, newObj interface{}) {
-			rc.reconcile(newObj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-	}, time.Minute)
-	err = rc.daemonSetsInformer.Informer().AddIndexers(imageIndexers)
-	if err != nil {
-		panic(err)
-	}
-	err = rc.daemonSetsInformer.Informer().SetTransform(getImagesFromDaemonSet)
-	if err != nil {
-		panic(err)
+	if checkSignatures || len(signaturePublicKeyPaths) > 0 {
+		keys, err := loadSignaturePublicKeys(signaturePublicKeyPaths)
+		if err != nil {
+			logrus.Fatalf("Failed to load signature public keys: %v", err)
+		}
+		rc.signatures = &signatureVerifier{keys: keys}
 	}
-	rc.controllerIndexers.daemonSetIndexer = rc.daemonSetsInformer.Informer().GetIndexer()
 
-	_, _ = rc.cronJobsInformer.Informer().AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-		UpdateFunc: func(_, newObj interface{}) {
-			rc.reconcile(newObj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			rc.reconcile(obj)
-		},
-	}, time.Minute)
-	err = rc.cronJobsInformer.Informer().AddIndexers(imageIndexers)
-	if err != nil {
-		panic(err)
+	if imageMetadata {
+		rc.metadata = newMetadataCache(metadataAnnotations)
 	}
-	err = rc.cronJobsInformer.Informer().SetTransform(getImagesFromCronJob)
-	if err != nil {
-		panic(err)
+
+	if checkPlatforms {
+		nodesInformer := informerFactory.Core().V1().Nodes().Informer()
+		err = nodesInformer.SetTransform(trimNode)
+		if err != nil {
+			panic(err)
+		}
+		rc.controllerIndexers.nodeIndexer = nodesInformer.GetIndexer()
 	}
-	rc.controllerIndexers.cronJobIndexer = rc.cronJobsInformer.Informer().GetIndexer()
 
 	namespace := "default"
 	// Create a context
@@ -253,21 +305,82 @@ func NewChecker(
 
 	rc.controllerIndexers.forceCheckDisabledControllerKinds = forceCheckDisabledControllerKinds
 
+	// Checks start right after the cache sync, so the providers have to be ready by then.
+	googleProvider, err := google.NewProvider(googleServiceAccountKeyPath)
+	if err != nil {
+		logrus.Fatalf("Error loading google service account key: %v", err)
+	}
+	providerChain := []providers.Provider{
+		amazon.NewProvider(ecrAssumeRoles),
+		googleProvider,
+		k8s.NewProvider(),
+	}
+	if credentialProviderConfig != "" {
+		kubeletProvider, err := kubelet.NewProvider(credentialProviderConfig, credentialProviderBinDir)
+		if err != nil {
+			logrus.Fatalf("Error loading credential provider config: %v", err)
+		}
+		providerChain = append(providerChain, kubeletProvider)
+	}
+	rc.providerRegistry = providers.NewProviderChain(providerChain...)
+
+	// Workloads are keyed by the pull secrets of their service accounts, see store.ImageKey.
+	_, _ = rc.serviceAccountInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: rc.reconcileServiceAccount,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if !slices.Equal(oldObj.(*corev1.ServiceAccount).ImagePullSecrets, newObj.(*corev1.ServiceAccount).ImagePullSecrets) {
+				rc.reconcileServiceAccount(newObj)
+			}
+		},
+	})
+
 	go informerFactory.Start(stopCh)
+	go dynamicInformerFactory.Start(stopCh)
 	logrus.Info("Waiting for cache sync")
 	informerFactory.WaitForCacheSync(stopCh)
+	dynamicInformerFactory.WaitForCacheSync(stopCh)
 	logrus.Info("Caches populated successfully")
 
-	rc.imageStore.RunGC(rc.controllerIndexers.GetContainerInfosForImage)
-	registry := providers.NewProviderChain(
-		amazon.NewProvider(),
-		k8s.NewProvider(rc.controllerIndexers.GetImagePullSecrets),
-	)
-	rc.providerRegistry = registry
+	// Images found during the initial sync are due immediately anyway, so only later changes take the fast path.
+	rc.synced.Store(true)
+	rc.imageStore.Run(stopCh)
+	go rc.runImmediateChecks(stopCh)
+
+	rc.imageStore.RunGC(func(key store.ImageKey) []store.ContainerInfo {
+		return rc.controllerIndexers.GetContainerInfosForImage(key.Image)[key.Credentials]
+	})
 
 	return rc
 }
 
+// setupControllerInformer registers the reconcile handler, the image indexer and the transform function
+// on the informer of a controller kind and returns its indexer.
+func (rc *Checker) setupControllerInformer(informer cache.SharedIndexInformer, transform cache.TransformFunc, resyncPeriod time.Duration) cache.Indexer {
+	_, _ = informer.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			rc.reconcile(obj, false)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			rc.reconcile(newObj, specChanged(oldObj, newObj))
+		},
+		DeleteFunc: func(obj interface{}) {
+			rc.reconcile(obj, false)
+		},
+	}, resyncPeriod)
+
+	err := informer.AddIndexers(imageIndexers)
+	if err != nil {
+		panic(err)
+	}
+
+	err = informer.SetTransform(transform)
+	if err != nil {
+		panic(err)
+	}
+
+	return informer.GetIndexer()
+}
+
 // Collect implements prometheus.Collector.
 func (rc *Checker) Collect(ch chan<- prometheus.Metric) {
 	metrics := rc.imageStore.ExtractMetrics()
@@ -275,20 +388,39 @@ func (rc *Checker) Collect(ch chan<- prometheus.Metric) {
 	for _, m := range metrics {
 		ch <- m
 	}
+
+	for _, m := range rc.imageStore.ExtractScheduleMetrics() {
+		ch <- m
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(
+			"k8s_image_availability_exporter_immediate_check_queue_depth",
+			"Number of new images and images of changed controllers that wait to be checked out of schedule.",
+			nil,
+			nil,
+		),
+		prometheus.GaugeValue,
+		float64(rc.immediateChecks.Len()),
+	)
 }
 
 // Describe implements prometheus.Collector.
 func (rc *Checker) Describe(_ chan<- *prometheus.Desc) {}
 
-func (rc *Checker) Tick() {
-	rc.imageStore.Check()
-}
-
-func (rc *Checker) reconcile(obj interface{}) {
+// reconcile updates images of the object in the store. New images are checked immediately,
+// as well as all images of the object if checkNow is set.
+func (rc *Checker) reconcile(obj interface{}, checkNow bool) {
 	cis := getCis(obj)
 
+	// Images of a Pod or a ReplicaSet are found by the image index when its owner is reconciled, so reconciling
+	// each of the pods of a DaemonSet would only rescan all of them over and over again.
+	if (cis.controllerKind == "Pod" || cis.controllerKind == "ReplicaSet") && rc.controllerIndexers.coveredByOwner(cis) {
+		return
+	}
+
 imagesLoop:
-	for _, image := range cis.containerToImages {
+	for _, image := range cis.images() {
 		for _, allowedImagesRegex := range rc.allowedImagesRegex {
 			if !allowedImagesRegex.MatchString(image) {
 				continue imagesLoop
@@ -301,20 +433,110 @@ imagesLoop:
 			}
 		}
 
-		containerInfos := rc.controllerIndexers.GetContainerInfosForImage(image)
+		// Workloads are checked with their own pull secrets only, so each credential set is a separate store entry.
+		for credentials, containerInfos := range rc.controllerIndexers.GetContainerInfosForImage(image) {
+			key := store.ImageKey{Image: image, Credentials: credentials}
+
+			isNew := rc.imageStore.ReconcileImage(key, containerInfos)
+			if (isNew || checkNow) && rc.synced.Load() {
+				rc.immediateChecks.Add(key)
+			}
+		}
+	}
+}
+
+// reconcileServiceAccount reconciles the objects of the namespace that are checked with the pull secrets
+// of the service account, i.e., the ones without pull secrets of their own.
+func (rc *Checker) reconcileServiceAccount(obj interface{}) {
+	sa := obj.(*corev1.ServiceAccount)
+
+	for _, indexer := range rc.controllerIndexers.controllerIndexers() {
+		objs, err := indexer.ByIndex(cache.NamespaceIndex, sa.Namespace)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+
+		for _, obj := range objs {
+			cis := getCis(obj)
+			if len(cis.pullSecretReferences) > 0 || cmp.Or(cis.serviceAccountName, "default") != sa.Name {
+				continue
+			}
+
+			rc.reconcile(obj, false)
+		}
+	}
+}
+
+// specChanged reports whether the spec of the object changed, its images are worth checking right away then,
+// e.g., in case of a rollout of the same mutable tag.
+func specChanged(oldObj, newObj interface{}) bool {
+	return getCis(oldObj).Generation != getCis(newObj).Generation
+}
+
+// runImmediateChecks checks images from the immediate checks queue, the rate limiter keeps a mass rollout
+// from flooding registries.
+func (rc *Checker) runImmediateChecks(stopCh <-chan struct{}) {
+	ctx := wait.ContextForChannel(stopCh)
+	go func() {
+		<-stopCh
+		rc.immediateChecks.ShutDown()
+	}()
+
+	for {
+		if err := rc.immediateChecksLimiter.Wait(ctx); err != nil {
+			return
+		}
+
+		key, shutdown := rc.immediateChecks.Get()
+		if shutdown {
+			return
+		}
 
-		rc.imageStore.ReconcileImage(image, containerInfos)
+		rc.imageStore.CheckNow(key)
+		rc.immediateChecks.Done(key)
 	}
 }
 
-func (rc *Checker) Check(imageName string) store.AvailabilityMode {
-	keyChain, err := rc.providerRegistry.GetAuthKeychain(imageName)
+// Check checks the image with the credential set of the key.
+func (rc *Checker) Check(key store.ImageKey) store.CheckResult {
+	imageName := key.Image
+
+	strict := rc.strictCredentials.selects(rc.RegistryHost(imageName))
+	keyChain, err := rc.providerRegistry.GetAuthKeychain(imageName, rc.controllerIndexers.GetPullSecrets(key.Credentials), strict)
 	if err != nil {
 		logrus.Warn("error while getting keychain for: ", err)
-		return store.AuthnFailure
+		return store.CheckResult{AvailMode: store.AuthnFailure}
 	}
 	log := logrus.WithField("image_name", imageName)
-	return rc.checkImageAvailability(log, imageName, keyChain)
+	if key.Credentials != "" {
+		log = log.WithField("pull_secrets", key.Credentials)
+	}
+
+	var opts checkOptions
+	if rc.checkPlatforms {
+		opts.platforms = rc.controllerIndexers.GetPlatformsForImage(imageName)
+	}
+	if rc.deepCheck.selects(imageName, rc.RegistryHost(imageName)) {
+		opts.blobs = rc.blobCache
+	}
+	opts.pull = rc.checkPulls
+
+	return rc.checkImageAvailability(log, imageName, keyChain, opts)
+}
+
+// RegistryHost returns the host of the registry the image is checked against, taking mirrors into account.
+func (rc *Checker) RegistryHost(imageName string) string {
+	if len(rc.config.mirrorsMap) > 0 {
+		imageName = getImageWithMirror(imageName, rc.config.mirrorsMap)
+	}
+
+	ref, err := parseImageName(imageName, rc.config.defaultRegistry, rc.config.plainHTTP)
+	if err != nil {
+		return ""
+	}
+
+	return ref.Context().RegistryStr()
 }
 
 func getImageWithMirror(originalImage string, mirrors map[string]string) string {
@@ -327,7 +549,7 @@ func getImageWithMirror(originalImage string, mirrors map[string]string) string
 	return originalImage
 }
 
-func (rc *Checker) checkImageAvailability(log *logrus.Entry, imageName string, kc authn.Keychain) (availMode store.AvailabilityMode) {
+func (rc *Checker) checkImageAvailability(log *logrus.Entry, imageName string, kc authn.Keychain, opts checkOptions) (result store.CheckResult) {
 	if len(rc.config.mirrorsMap) > 0 {
 		imageName = getImageWithMirror(imageName, rc.config.mirrorsMap)
 	}
@@ -337,33 +559,91 @@ func (rc *Checker) checkImageAvailability(log *logrus.Entry, imageName string, k
 		return checkImageNameParseErr(log, err)
 	}
 
+	// In the strict mode, only the credentials kubelet would use are tried.
+	strict := rc.strictCredentials.selects(ref.Context().RegistryStr())
+	if !strict {
+		kc = withDefaultKeychain(kc)
+	}
+
 	imgErr := wait.ExponentialBackoff(wait.Backoff{
 		Duration: time.Second,
 		Factor:   2,
 		Steps:    2,
 	}, func() (bool, error) {
 		var err error
-		availMode, err = check(ref, kc, rc.registryTransport)
+		result, err = check(ref, kc, rc.registryTransport, opts)
 
-		return availMode == store.Available, err
+		return result.AvailMode == store.Available, err
 	})
 
-	if availMode != store.Available {
-		log.WithField("availability_mode", availMode.String()).Error(imgErr)
+	if result.AvailMode == store.RateLimited {
+		result.RetryAfter = rc.retryAfter.RetryAfter(ref.Context().RegistryStr())
+	}
+
+	if strict {
+		result.StrictCredentials = true
+		if result.AvailMode != store.Available && credentialsMismatch(ref, result.AvailMode, rc.registryTransport) {
+			result.CredentialsMismatch = true
+			log.Warn("Image is available with the default keychain of the exporter, but not with the credentials of the workload")
+		}
+	}
+
+	if tag, ok := pinnedTag(imageName, rc.config.defaultRegistry, rc.config.plainHTTP); ok && result.AvailMode == store.Available {
+		result.PinnedTag = true
+		result.TagDigestMismatch = tagDigestMismatch(log, tag, ref.Identifier(), kc, rc.registryTransport)
+	}
+
+	if rc.signatures != nil && result.AvailMode == store.Available && result.Digest != "" {
+		signed, err := rc.signatures.signed(ref.Context().Digest(result.Digest), kc, rc.registryTransport)
+		if err != nil {
+			log.Warnf("Failed to look up image signatures: %v", err)
+		} else {
+			result.SignatureChecked = true
+			result.Signed = signed
+		}
+	}
+
+	if len(rc.requiredArtifactTypes) > 0 && result.AvailMode == store.Available && result.Digest != "" {
+		artifacts, err := referrerArtifacts(ref.Context().Digest(result.Digest), rc.requiredArtifactTypes, kc, rc.registryTransport)
+		if err != nil {
+			log.Warnf("Failed to look up referrers of the image: %v", err)
+		} else {
+			result.ReferrerArtifacts = artifacts
+			if missing := missingArtifactTypes(artifacts); len(missing) > 0 {
+				log.WithField("missing_artifact_types", strings.Join(missing, ",")).Warn("Image has no referrers of the required artifact types")
+			}
+		}
+	}
+
+	if rc.metadata != nil && result.AvailMode == store.Available && result.Digest != "" {
+		metadata, err := rc.metadata.get(ref.Context().Digest(result.Digest), opts.platforms, kc, rc.registryTransport)
+		if err != nil {
+			log.Warnf("Failed to fetch image metadata: %v", err)
+		} else {
+			result.Metadata = &metadata
+		}
+	}
+
+	if result.AvailMode != store.Available {
+		entry := log.WithField("availability_mode", result.AvailMode.String())
+		if result.Reason != "" {
+			entry = entry.WithField("reason", result.Reason)
+		}
+		entry.Error(imgErr)
 	}
 
 	return
 }
 
-func checkImageNameParseErr(log *logrus.Entry, err error) store.AvailabilityMode {
+func checkImageNameParseErr(log *logrus.Entry, err error) store.CheckResult {
 	var parseErr *name.ErrBadName
 	if errors.As(err, &parseErr) {
 		log.WithField("availability_mode", store.BadImageName.String()).Error(err)
-		return store.BadImageName
+		return store.CheckResult{AvailMode: store.BadImageName}
 	}
 
 	log.WithField("availability_mode", store.UnknownError.String()).Error(err)
-	return store.UnknownError
+	return store.CheckResult{AvailMode: store.UnknownError}
 }
 
 func parseImageName(image string, defaultRegistry string, plainHTTP bool) (name.Reference, error) {
@@ -391,40 +671,201 @@ func parseImageName(image string, defaultRegistry string, plainHTTP bool) (name.
 	return ref, nil
 }
 
-func check(ref name.Reference, kc authn.Keychain, registryTransport http.RoundTripper) (store.AvailabilityMode, error) {
-	var imgErr error
+// pinnedTag returns the tag of a "repo:tag@digest" reference. The runtime pulls such images by the digest
+// and ignores the tag.
+func pinnedTag(image string, defaultRegistry string, plainHTTP bool) (name.Tag, bool) {
+	base, _, found := strings.Cut(image, "@")
+	if !found {
+		return name.Tag{}, false
+	}
+
+	// The colon after the last slash separates the tag, others may belong to the registry port.
+	if !strings.Contains(base[strings.LastIndex(base, "/")+1:], ":") {
+		return name.Tag{}, false
+	}
+
+	ref, err := parseImageName(base, defaultRegistry, plainHTTP)
+	if err != nil {
+		return name.Tag{}, false
+	}
+
+	tag, ok := ref.(name.Tag)
+
+	return tag, ok
+}
+
+// tagDigestMismatch reports whether the tag no longer points at the pinned digest, including the case when
+// the tag is gone. The check is skipped if the tag cannot be resolved for any other reason.
+func tagDigestMismatch(log *logrus.Entry, tag name.Tag, digest string, kc authn.Keychain, registryTransport http.RoundTripper) bool {
+	result, err := check(tag, kc, registryTransport, checkOptions{})
+
+	switch result.AvailMode {
+	case store.Available:
+		// A digest may pin the manifest of a single platform of the index the tag points at.
+		if result.Digest != "" && result.Digest != digest && !indexHasManifest(log, tag.Context().Digest(result.Digest), digest, kc, registryTransport) {
+			log.WithField("tag_digest", result.Digest).Warnf("Tag %q no longer points at the pinned digest", tag.TagStr())
+			return true
+		}
+	case store.ManifestAbsent, store.Absent:
+		log.Warnf("Tag %q of the pinned digest does not exist", tag.TagStr())
+		return true
+	default:
+		log.WithField("availability_mode", result.AvailMode.String()).Warnf("Failed to resolve tag %q of the pinned digest: %v", tag.TagStr(), err)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	return false
+}
+
+// indexHasManifest reports whether the manifest is one of the platform manifests of the index, false is returned
+// if the reference is not an index or cannot be fetched.
+func indexHasManifest(log *logrus.Entry, index name.Digest, manifest string, kc authn.Keychain, registryTransport http.RoundTripper) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
-	// Fallback to default keychain if image is not found in the provided one.
-	// This is a behavior that is close to what CRI does. Because, there is maybe an image pull secret, but with
-	// the wrong credentials. Yet, the image may be available with the default keychain.
+	desc, err := remote.Get(index,
+		remote.WithAuthFromKeychain(keychainOrAnonymous(kc)),
+		remote.WithTransport(registryTransport),
+		remote.WithContext(ctx),
+	)
+	if err != nil {
+		log.Warnf("Failed to fetch the manifest %q the tag of the pinned digest points at: %v", index.DigestStr(), err)
+		return false
+	}
+	if !desc.MediaType.IsIndex() {
+		return false
+	}
+
+	imageIndex, err := desc.ImageIndex()
+	if err != nil {
+		log.Warnf("Failed to parse the index %q the tag of the pinned digest points at: %v", index.DigestStr(), err)
+		return false
+	}
+	indexManifest, err := imageIndex.IndexManifest()
+	if err != nil {
+		log.Warnf("Failed to parse the index %q the tag of the pinned digest points at: %v", index.DigestStr(), err)
+		return false
+	}
+
+	return slices.ContainsFunc(indexManifest.Manifests, func(d v1.Descriptor) bool { return d.Digest.String() == manifest })
+}
+
+// withDefaultKeychain falls back to the default keychain if the image is not found in the provided one.
+// This is a behavior that is close to what CRI does. Because, there is maybe an image pull secret, but with
+// the wrong credentials. Yet, the image may be available with the default keychain.
+func withDefaultKeychain(kc authn.Keychain) authn.Keychain {
 	if kc != nil {
-		kc = authn.NewMultiKeychain(kc, authn.DefaultKeychain)
-	} else {
-		kc = authn.DefaultKeychain
+		return authn.NewMultiKeychain(kc, authn.DefaultKeychain)
 	}
 
-	_, imgErr = remote.Head(
-		ref,
+	return authn.DefaultKeychain
+}
+
+// requestTimeout limits the requests of a check, the manifest requests share it, while the further verifications,
+// e.g., of every layer of the image, get a timeout of their own, see withRequestTimeout.
+const requestTimeout = 15 * time.Second
+
+// withRequestTimeout runs the request with a timeout of its own, so that checks issuing lots of requests
+// do not run out of time.
+func withRequestTimeout(opts []remote.Option, request func(opts ...remote.Option) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return request(append(slices.Clip(opts), remote.WithContext(ctx))...)
+}
+
+// checkOptions enable optional verifications of check.
+type checkOptions struct {
+	// platforms the image must have manifests for.
+	platforms []v1.Platform
+	// blobs enables the deep check of config and layer blobs, verified blobs are cached there.
+	blobs *blobCache
+	// pull enables the manifest GET that registry pull policies apply to.
+	pull bool
+}
+
+// check checks the image manifest, the options enable additional verifications of an existing manifest.
+func check(ref name.Reference, kc authn.Keychain, registryTransport http.RoundTripper, checkOpts checkOptions) (store.CheckResult, error) {
+	var imgErr error
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	kc = keychainOrAnonymous(kc)
+
+	opts := []remote.Option{
 		remote.WithAuthFromKeychain(kc),
 		remote.WithTransport(registryTransport),
 		remote.WithContext(ctx),
-	)
+	}
+
+	var result store.CheckResult
+
+	desc, imgErr := remote.Head(ref, opts...)
+	// HEAD responses carry no body, so the registry error codes that tell a missing repository from a missing tag
+	// are only available from a GET request. Errors of the further verifications come from GET requests already.
+	if NeedsErrorBody(imgErr) {
+		var getDesc *remote.Descriptor
+		if getDesc, imgErr = remote.Get(ref, opts...); imgErr == nil {
+			desc = &getDesc.Descriptor
+		}
+	}
+	if imgErr == nil {
+		result.Digest = desc.Digest.String()
+	}
+
+	if imgErr == nil && checkOpts.pull {
+		imgErr = pullManifest(ctx, ref, kc, registryTransport)
+	}
+
+	var missingBlobDigests []string
+	if imgErr == nil && checkOpts.blobs != nil {
+		missingBlobDigests, imgErr = missingBlobs(ref, desc, checkOpts.platforms, checkOpts.blobs, opts...)
+	}
+
+	var missing []string
+	if imgErr == nil && len(checkOpts.platforms) > 0 {
+		imgErr = withRequestTimeout(opts, func(opts ...remote.Option) (err error) {
+			missing, err = missingPlatforms(ref, desc, checkOpts.platforms, opts...)
+			return
+		})
+	}
 
-	var availMode store.AvailabilityMode
-	if IsAbsent(imgErr) {
-		availMode = store.Absent
+	if IsRateLimited(imgErr) {
+		result.AvailMode = store.RateLimited
+	} else if IsPullBlocked(imgErr) {
+		result.AvailMode = store.PullBlocked
+		result.Reason = ReasonPolicy
+	} else if IsRepositoryAbsent(imgErr) {
+		result.AvailMode = store.RepositoryAbsent
+	} else if IsManifestAbsent(imgErr) {
+		result.AvailMode = store.ManifestAbsent
+	} else if IsBadRepositoryName(imgErr) {
+		result.AvailMode = store.BadRepositoryName
+	} else if IsBadTag(imgErr) {
+		result.AvailMode = store.BadTag
+	} else if IsAbsent(imgErr) {
+		result.AvailMode = store.Absent
 	} else if IsAuthnFail(imgErr) {
-		availMode = store.AuthnFailure
+		result.AvailMode = store.AuthnFailure
 	} else if IsAuthzFail(imgErr) {
-		availMode = store.AuthzFailure
+		result.AvailMode = store.AuthzFailure
 	} else if IsOldRegistry(imgErr) {
-		availMode = store.Available
+		result.AvailMode = store.Available
+	} else if reason := UnavailabilityReason(imgErr); reason != "" {
+		result.AvailMode = store.RegistryUnavailable
+		result.Reason = reason
 	} else if imgErr != nil {
-		availMode = store.UnknownError
+		result.AvailMode = store.UnknownError
+	} else if len(missingBlobDigests) > 0 {
+		result.AvailMode = store.BlobMissing
+		result.Reason = ReasonBlobMissing
+		result.MissingBlobs = missingBlobDigests
+		imgErr = blobMissingError(missingBlobDigests)
+	} else if len(missing) > 0 {
+		result.AvailMode = store.PlatformMismatch
+		result.Reason = strings.Join(missing, ",")
+		imgErr = platformMismatchError(missing)
 	}
 
-	return availMode, imgErr
+	return result, imgErr
 }
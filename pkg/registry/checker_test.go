@@ -1,10 +1,35 @@
 package registry
 
 import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/google/go-containerregistry/pkg/authn"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
 )
 
 func Test_parseImageName(t *testing.T) {
@@ -26,3 +51,333 @@ func Test_parseImageName(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, path.Join(defaultRegistryName, goodImageNameWithoutRegistry), ref.Name())
 }
+
+func Test_check(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, err := parseImageName(host+"/test/image:present", "", true)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		image     string
+		availMode store.AvailabilityMode
+		digest    string
+	}{
+		{image: "test/image:present", availMode: store.Available, digest: digest.String()},
+		{image: "test/image:missing", availMode: store.ManifestAbsent},
+		{image: "test/missing:latest", availMode: store.RepositoryAbsent},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			ref, err := parseImageName(host+"/"+tc.image, "", true)
+			require.NoError(t, err)
+
+			result, _ := check(ref, nil, http.DefaultTransport, checkOptions{})
+			require.Equal(t, tc.availMode, result.AvailMode)
+			require.Equal(t, tc.digest, result.Digest)
+		})
+	}
+}
+
+func Test_pinnedTag(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	for _, tc := range []struct {
+		image string
+		tag   string
+	}{
+		{image: "registry.example.com:5000/app:v1@" + digest, tag: "registry.example.com:5000/app:v1"},
+		{image: "app:v1@" + digest, tag: "index.docker.io/library/app:v1"},
+		{image: "registry.example.com:5000/app@" + digest},
+		{image: "registry.example.com:5000/app:v1"},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			tag, ok := pinnedTag(tc.image, "", false)
+			require.Equal(t, tc.tag != "", ok)
+			if ok {
+				require.Equal(t, tc.tag, tag.Name())
+			}
+		})
+	}
+}
+
+func Test_tagDigestMismatch(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	push := func(image string) string {
+		t.Helper()
+
+		ref, err := parseImageName(host+"/"+image, "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+
+		digest, err := img.Digest()
+		require.NoError(t, err)
+
+		return digest.String()
+	}
+
+	stable := push("test/image:stable")
+	moved := push("test/image:moved")
+	push("test/image:moved")
+
+	// The digest of a single platform is pinned, while the tag points at the index.
+	indexRef, err := parseImageName(host+"/test/image:multi-platform", "", true)
+	require.NoError(t, err)
+	index, err := random.Index(1024, 1, 2)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(indexRef, index))
+	indexManifest, err := index.IndexManifest()
+	require.NoError(t, err)
+	platform := indexManifest.Manifests[0].Digest.String()
+
+	logEntry := logrus.NewEntry(logrus.New())
+	logEntry.Logger.SetOutput(io.Discard)
+
+	for _, tc := range []struct {
+		image    string
+		mismatch bool
+	}{
+		{image: "test/image:stable@" + stable, mismatch: false},
+		{image: "test/image:moved@" + moved, mismatch: true},
+		{image: "test/image:missing@" + stable, mismatch: true},
+		{image: "test/image:multi-platform@" + platform, mismatch: false},
+		{image: "test/image:multi-platform@" + stable, mismatch: true},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			tag, ok := pinnedTag(host+"/"+tc.image, "", true)
+			require.True(t, ok)
+
+			_, digest, _ := strings.Cut(tc.image, "@")
+			require.Equal(t, tc.mismatch, tagDigestMismatch(logEntry, tag, digest, nil, http.DefaultTransport))
+		})
+	}
+}
+
+func Test_check_errorBody(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	configDigest, err := img.ConfigName()
+	require.NoError(t, err)
+
+	// Emulate a registry that responds to HEAD requests of missing manifests and to GET requests of lost blobs
+	// with a bare 404, without the error codes in the body.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/manifests/missing") ||
+			r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+configDigest.String()) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		registryHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, err := parseImageName(host+"/test/image:present", "", true)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	for _, tc := range []struct {
+		image     string
+		platforms []v1.Platform
+		availMode store.AvailabilityMode
+	}{
+		{image: "test/image:missing", availMode: store.ManifestAbsent},
+		// The manifest exists, so the error of the platform check must not be refined by a GET of the manifest.
+		{image: "test/image:present", platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}}, availMode: store.Absent},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			ref, err := parseImageName(host+"/"+tc.image, "", true)
+			require.NoError(t, err)
+
+			result, _ := check(ref, nil, http.DefaultTransport, checkOptions{platforms: tc.platforms})
+			require.Equal(t, tc.availMode, result.AvailMode)
+		})
+	}
+}
+
+func Test_NewChecker(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, err := parseImageName(host+"/test/image:present", "", true)
+	require.NoError(t, err)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	// The workload exists before the start, so its image is checked right after the cache sync.
+	kubeClient := kubefake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](1),
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: ref.String()}},
+			}},
+		},
+	})
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	rc := NewChecker(
+		stopCh, kubeClient, false, true, nil, nil, nil, nil, "", "", nil, dynamicClient, nil, 0,
+		2, 0, 100*time.Millisecond, time.Second, time.Second, 1, 10,
+		false, nil, nil, false, false, nil, nil, false, nil, false, nil,
+		"", "", nil, "",
+	)
+
+	require.Eventually(t, func() bool { return imageAvailable(t, rc) }, 30*time.Second, 10*time.Millisecond)
+}
+
+func Test_NewChecker_serviceAccountPullSecrets(t *testing.T) {
+	registry := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, err := parseImageName(host+"/test/image:present", "", true)
+	require.NoError(t, err)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "password"})))
+
+	kubeClient := kubefake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "regcred"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + host + `":{"username":"user","password":"password"}}}`),
+		},
+	}, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](1),
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: ref.String()}},
+			}},
+		},
+	})
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	rc := NewChecker(
+		stopCh, kubeClient, false, true, nil, nil, nil, nil, "", "", nil, dynamicClient, nil, 0,
+		2, 0, time.Hour, time.Hour, time.Hour, 1, 10,
+		false, nil, nil, false, false, nil, nil, false, nil, false, nil,
+		"", "", nil, "",
+	)
+
+	require.Eventually(t, func() bool {
+		available, found := imageAvailability(t, rc)
+		return found && !available
+	}, 30*time.Second, 10*time.Millisecond)
+
+	// The service account appears after the deployment, its pull secrets are picked up without waiting for a resync.
+	_, err = kubeClient.CoreV1().ServiceAccounts("default").Create(context.Background(), &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Namespace: "default", Name: "default"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return imageAvailable(t, rc) }, 30*time.Second, 10*time.Millisecond)
+}
+
+// imageAvailable reports whether the only image of the checker is available.
+func imageAvailable(t *testing.T, rc *Checker) bool {
+	t.Helper()
+
+	available, found := imageAvailability(t, rc)
+	return found && available
+}
+
+// imageAvailability returns the availability of the only image of the checker, found is false until it is in the store.
+// Images are reported available until their first check.
+func imageAvailability(t *testing.T, rc *Checker) (available, found bool) {
+	t.Helper()
+
+	for _, m := range rc.imageStore.ExtractMetrics() {
+		if !strings.Contains(m.Desc().String(), `"k8s_image_availability_exporter_available"`) {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+		return metric.Gauge.GetValue() == 1, true
+	}
+
+	return false, false
+}
+
+func Test_specChanged(t *testing.T) {
+	cis := func(generation int64) *controllerWithContainerInfos {
+		return &controllerWithContainerInfos{ObjectMeta: metav1.ObjectMeta{Generation: generation}}
+	}
+
+	require.False(t, specChanged(cis(1), cis(1)), "status update")
+	require.True(t, specChanged(cis(1), cis(2)))
+}
+
+func Test_runImmediateChecks(t *testing.T) {
+	var checks atomic.Int32
+	imageStore := store.NewImageStore(func(store.ImageKey) store.CheckResult {
+		checks.Add(1)
+		return store.CheckResult{AvailMode: store.Available}
+	}, func(string) string { return "registry.test" }, 1, 0, time.Hour, time.Hour, time.Hour)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	imageStore.Run(stopCh)
+
+	keys := []store.ImageKey{{Image: "test_0"}, {Image: "test_1"}, {Image: "test_2"}}
+	for _, key := range keys {
+		imageStore.ReconcileImage(key, []store.ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: key.Image, Container: "test"}})
+	}
+	require.Eventually(t, func() bool { return checks.Load() == 3 }, 10*time.Second, 10*time.Millisecond)
+
+	rc := &Checker{
+		imageStore:             imageStore,
+		immediateChecks:        workqueue.NewTyped[store.ImageKey](),
+		immediateChecksLimiter: rate.NewLimiter(rate.Every(time.Hour), 2),
+	}
+	for _, key := range keys {
+		rc.immediateChecks.Add(key)
+	}
+	go rc.runImmediateChecks(stopCh)
+
+	// The burst is used up by the first two images, the third one waits for the limiter.
+	require.Eventually(t, func() bool { return checks.Load() == 5 }, 10*time.Second, 10*time.Millisecond)
+	require.Never(t, func() bool { return checks.Load() > 5 }, 200*time.Millisecond, 10*time.Millisecond)
+	require.Equal(t, 1, rc.immediateChecks.Len())
+}
@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// strictCredentialsSelector selects registries whose images are checked with the credentials kubelet would use only,
+// without falling back to the default keychain of the exporter.
+type strictCredentialsSelector struct {
+	all        bool
+	registries []string
+}
+
+func (s strictCredentialsSelector) selects(registry string) bool {
+	return s.all || slices.Contains(s.registries, registry)
+}
+
+// keychainOrAnonymous returns the keychain, or a keychain that resolves to anonymous access if there is none.
+func keychainOrAnonymous(kc authn.Keychain) authn.Keychain {
+	if kc != nil {
+		return kc
+	}
+
+	return authn.NewMultiKeychain()
+}
+
+// credentialsMismatchModes are the check results that may be caused by the credentials of the workload,
+// registries often hide private repositories behind "not found" errors.
+var credentialsMismatchModes = []store.AvailabilityMode{
+	store.AuthnFailure,
+	store.AuthzFailure,
+	store.Absent,
+	store.RepositoryAbsent,
+	store.ManifestAbsent,
+}
+
+// credentialsMismatch reports whether the image that failed the strict check is available with the default keychain,
+// i.e., the non-strict check would only pass thanks to the fallback.
+func credentialsMismatch(ref name.Reference, mode store.AvailabilityMode, registryTransport http.RoundTripper) bool {
+	if !slices.Contains(credentialsMismatchModes, mode) {
+		return false
+	}
+
+	result, _ := check(ref, authn.DefaultKeychain, registryTransport, checkOptions{})
+
+	return result.AvailMode == store.Available
+}
@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_strictCredentialsSelector(t *testing.T) {
+	assert.True(t, strictCredentialsSelector{all: true}.selects("registry.test"))
+	assert.True(t, strictCredentialsSelector{registries: []string{"registry.test"}}.selects("registry.test"))
+	assert.False(t, strictCredentialsSelector{registries: []string{"registry.test"}}.selects("other.test"))
+}
+
+func Test_credentialsMismatch(t *testing.T) {
+	// The default keychain of the exporter has no credentials.
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	public, err := parseImageName(host+"/test/public:latest", "", true)
+	require.NoError(t, err)
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(public, img))
+
+	missing, err := parseImageName(host+"/test/missing:latest", "", true)
+	require.NoError(t, err)
+
+	assert.True(t, credentialsMismatch(public, store.AuthnFailure, http.DefaultTransport), "a broken pull secret of a public image")
+	assert.False(t, credentialsMismatch(public, store.RegistryUnavailable, http.DefaultTransport), "failures unrelated to credentials are not retried")
+	assert.False(t, credentialsMismatch(missing, store.ManifestAbsent, http.DefaultTransport))
+}
@@ -0,0 +1,334 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// CustomResourceConfig describes how to extract images from a custom resource that embeds a pod template or
+// container-like objects, e.g., Argo Rollouts, OpenKruise CloneSets, KubeVirt VirtualMachines or Tekton Tasks.
+// All paths are JSONPath expressions in the kubectl format, e.g., "{.spec.template.spec.containers[*]}".
+type CustomResourceConfig struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// Kind is used for the "kind" label, the kind of the object is used if omitted.
+	Kind string `json:"kind,omitempty"`
+
+	Containers         []CustomResourceContainersConfig `json:"containers"`
+	ImagePullSecrets   string                           `json:"imagePullSecrets,omitempty"`
+	ServiceAccountName string                           `json:"serviceAccountName,omitempty"`
+	// Enabled is a predicate, the object is considered enabled if the expression yields a non-empty value
+	// other than false, 0 or "False". Objects are always enabled if omitted.
+	Enabled string `json:"enabled,omitempty"`
+
+	containers         []customResourceContainersPath
+	imagePullSecrets   *jsonpath.JSONPath
+	serviceAccountName *jsonpath.JSONPath
+	enabled            *jsonpath.JSONPath
+}
+
+// CustomResourceContainersConfig selects a list of container-like objects. Name and Image are evaluated
+// relative to each selected object and default to "{.name}" and "{.image}".
+type CustomResourceContainersConfig struct {
+	Path  string `json:"path"`
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image,omitempty"`
+	// Type is used for the "container_type" label, defaults to "regular".
+	Type string `json:"type,omitempty"`
+}
+
+type customResourceContainersPath struct {
+	path          *jsonpath.JSONPath
+	name          *jsonpath.JSONPath
+	image         *jsonpath.JSONPath
+	containerType string
+}
+
+// LoadCustomResourceConfigs reads a YAML list of CustomResourceConfig from the file and compiles its paths.
+func LoadCustomResourceConfigs(path string) ([]CustomResourceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []CustomResourceConfig
+	if err := yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", path, err)
+	}
+
+	for i := range configs {
+		if err := configs[i].compile(); err != nil {
+			return nil, fmt.Errorf("custom resource %q: %w", configs[i].GroupVersionResource().String(), err)
+		}
+	}
+
+	return configs, nil
+}
+
+func (c *CustomResourceConfig) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: c.Group, Version: c.Version, Resource: c.Resource}
+}
+
+func (c *CustomResourceConfig) compile() (err error) {
+	if c.Version == "" || c.Resource == "" {
+		return fmt.Errorf("version and resource are required")
+	}
+	if len(c.Containers) == 0 {
+		return fmt.Errorf("at least one containers path is required")
+	}
+
+	c.containers = make([]customResourceContainersPath, 0, len(c.Containers))
+	for _, containersConfig := range c.Containers {
+		var p customResourceContainersPath
+
+		if p.path, err = compileJSONPath("containers", containersConfig.Path); err != nil {
+			return err
+		}
+		if p.name, err = compileJSONPath("name", defaultString(containersConfig.Name, "{.name}")); err != nil {
+			return err
+		}
+		if p.image, err = compileJSONPath("image", defaultString(containersConfig.Image, "{.image}")); err != nil {
+			return err
+		}
+		p.containerType = defaultString(containersConfig.Type, store.ContainerTypeRegular)
+
+		c.containers = append(c.containers, p)
+	}
+
+	if c.imagePullSecrets, err = compileJSONPath("imagePullSecrets", c.ImagePullSecrets); err != nil {
+		return err
+	}
+	if c.serviceAccountName, err = compileJSONPath("serviceAccountName", c.ServiceAccountName); err != nil {
+		return err
+	}
+	if c.enabled, err = compileJSONPath("enabled", c.Enabled); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func compileJSONPath(name, expression string) (*jsonpath.JSONPath, error) {
+	if expression == "" {
+		return nil, nil
+	}
+
+	jp := jsonpath.New(name).AllowMissingKeys(true)
+	if err := jp.Parse(expression); err != nil {
+		return nil, fmt.Errorf("parsing %s path %q: %w", name, expression, err)
+	}
+
+	return jp, nil
+}
+
+func defaultString(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// setupCustomResourceInformers creates dynamic informers for configured custom resources that are served by
+// the API server. Resources that are not served are skipped, otherwise the cache would never sync.
+func (rc *Checker) setupCustomResourceInformers(
+	informerFactory dynamicinformer.DynamicSharedInformerFactory,
+	discoveryClient discovery.DiscoveryInterface,
+	configs []CustomResourceConfig,
+) {
+	rc.controllerIndexers.customResourceIndexers = make(map[schema.GroupVersionResource]cache.Indexer)
+	rc.controllerIndexers.customResourceKinds = make(map[schema.GroupKind]schema.GroupVersionResource)
+
+	for i := range configs {
+		config := &configs[i]
+		gvr := config.GroupVersionResource()
+
+		kind, served := servedResourceKind(discoveryClient, gvr)
+		if !served {
+			logrus.Warnf("Custom resource %q is not served by the API server, skipping it", gvr.String())
+			continue
+		}
+		if config.Kind == "" {
+			config.Kind = kind
+		}
+
+		informer := informerFactory.ForResource(gvr).Informer()
+		rc.controllerIndexers.customResourceIndexers[gvr] = rc.setupControllerInformer(informer, getImagesFromCustomResource(config), controllerResyncPeriod)
+		rc.controllerIndexers.customResourceKinds[schema.GroupKind{Group: gvr.Group, Kind: kind}] = gvr
+	}
+}
+
+func servedResourceKind(discoveryClient discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (string, bool) {
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return "", false
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Name == gvr.Resource {
+			return resource.Kind, true
+		}
+	}
+
+	return "", false
+}
+
+func getImagesFromCustomResource(config *CustomResourceConfig) cache.TransformFunc {
+	return func(obj interface{}) (interface{}, error) {
+		if cis, ok := obj.(*controllerWithContainerInfos); ok {
+			return cis, nil
+		}
+
+		u := obj.(*unstructured.Unstructured)
+
+		objectMeta, err := objectMetaFromUnstructured(u)
+		if err != nil {
+			return nil, err
+		}
+
+		containerToImages := make(map[string]containerImage)
+		for _, containersPath := range config.containers {
+			for _, item := range findValues(containersPath.path, u.Object) {
+				image := findString(containersPath.image, item)
+				if image == "" {
+					continue
+				}
+
+				// Fall back to a positional name for objects that have no name of their own.
+				containerName := findString(containersPath.name, item)
+				if containerName == "" {
+					containerName = containersPath.containerType + "-" + strconv.Itoa(len(containerToImages))
+				}
+
+				containerToImages[containerName] = containerImage{image: image, containerType: containersPath.containerType}
+			}
+		}
+
+		var pullSecretReferences []corev1.LocalObjectReference
+		for _, item := range findValues(config.imagePullSecrets, u.Object) {
+			switch secret := item.(type) {
+			case string:
+				pullSecretReferences = append(pullSecretReferences, corev1.LocalObjectReference{Name: secret})
+			case map[string]interface{}:
+				if secretName, ok := secret["name"].(string); ok {
+					pullSecretReferences = append(pullSecretReferences, corev1.LocalObjectReference{Name: secretName})
+				}
+			}
+		}
+
+		return &controllerWithContainerInfos{
+			ObjectMeta:           objectMeta,
+			controllerKind:       config.Kind,
+			containerToImages:    containerToImages,
+			pullSecretReferences: pullSecretReferences,
+			serviceAccountName:   findString(config.serviceAccountName, u.Object),
+			enabled:              config.enabled == nil || isTruthy(findValues(config.enabled, u.Object)),
+		}, nil
+	}
+}
+
+func objectMetaFromUnstructured(u *unstructured.Unstructured) (objectMeta metav1.ObjectMeta, err error) {
+	metadata, ok := u.Object["metadata"].(map[string]interface{})
+	if !ok {
+		return objectMeta, fmt.Errorf("object %s has no metadata", u.GetName())
+	}
+
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(metadata, &objectMeta)
+
+	return objectMeta, err
+}
+
+// findValues returns the values selected by the expression, flattening the lists it selects.
+func findValues(jp *jsonpath.JSONPath, data interface{}) (ret []interface{}) {
+	if jp == nil {
+		return nil
+	}
+
+	results, err := jp.FindResults(data)
+	if err != nil {
+		logrus.Debug(err)
+		return nil
+	}
+
+	for _, result := range results {
+		for _, value := range result {
+			if !value.IsValid() {
+				continue
+			}
+			if value.Kind() == reflect.Interface && value.IsNil() {
+				continue
+			}
+
+			if items, ok := value.Interface().([]interface{}); ok {
+				ret = append(ret, items...)
+				continue
+			}
+
+			ret = append(ret, value.Interface())
+		}
+	}
+
+	return ret
+}
+
+func findString(jp *jsonpath.JSONPath, data interface{}) string {
+	if jp == nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err := jp.Execute(&buf, data); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+func isTruthy(values []interface{}) bool {
+	if len(values) == 0 {
+		return false
+	}
+
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			return false
+		case bool:
+			if !v {
+				return false
+			}
+		case int64:
+			if v == 0 {
+				return false
+			}
+		case float64:
+			if v == 0 {
+				return false
+			}
+		case string:
+			if v == "" || strings.EqualFold(v, "false") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testCustomResourcesConfig = `
+- group: argoproj.io
+  version: v1alpha1
+  resource: rollouts
+  kind: Rollout
+  containers:
+  - path: "{.spec.template.spec.containers[*]}"
+  - path: "{.spec.template.spec.initContainers[*]}"
+    type: init
+  imagePullSecrets: "{.spec.template.spec.imagePullSecrets[*]}"
+  serviceAccountName: "{.spec.template.spec.serviceAccountName}"
+  enabled: "{.spec.replicas}"
+- group: kubevirt.io
+  version: v1
+  resource: virtualmachines
+  kind: VirtualMachine
+  containers:
+  - path: "{.spec.template.spec.volumes[?(@.containerDisk)]}"
+    image: "{.containerDisk.image}"
+`
+
+func loadTestCustomResourceConfigs(t *testing.T) []CustomResourceConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "custom-resources.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testCustomResourcesConfig), 0o600))
+
+	configs, err := LoadCustomResourceConfigs(path)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	return configs
+}
+
+func Test_getImagesFromCustomResource(t *testing.T) {
+	configs := loadTestCustomResourceConfigs(t)
+
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]interface{}{"namespace": "ns", "name": "app"},
+		"spec": map[string]interface{}{
+			"replicas": int64(0),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"serviceAccountName": "app",
+					"imagePullSecrets":   []interface{}{map[string]interface{}{"name": "registry"}},
+					"initContainers":     []interface{}{map[string]interface{}{"name": "migrations", "image": "migrations:v1"}},
+					"containers":         []interface{}{map[string]interface{}{"name": "app", "image": "app:v1"}},
+				},
+			},
+		},
+	}}
+
+	obj, err := getImagesFromCustomResource(&configs[0])(rollout)
+	require.NoError(t, err)
+
+	cis := obj.(*controllerWithContainerInfos)
+	require.Equal(t, "Rollout", cis.controllerKind)
+	require.Equal(t, "ns", cis.Namespace)
+	require.Equal(t, "app", cis.Name)
+	require.Equal(t, "app", cis.serviceAccountName)
+	require.Equal(t, []corev1.LocalObjectReference{{Name: "registry"}}, cis.pullSecretReferences)
+	require.False(t, cis.enabled)
+	require.Equal(t, map[string]containerImage{
+		"app":        {image: "app:v1", containerType: store.ContainerTypeRegular},
+		"migrations": {image: "migrations:v1", containerType: store.ContainerTypeInit},
+	}, cis.containerToImages)
+
+	// A missing field yields an empty value, which disables the resource.
+	delete(rollout.Object["spec"].(map[string]interface{}), "replicas")
+	obj, err = getImagesFromCustomResource(&configs[0])(rollout)
+	require.NoError(t, err)
+	require.False(t, obj.(*controllerWithContainerInfos).enabled)
+
+	vm := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata":   map[string]interface{}{"namespace": "ns", "name": "vm"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"volumes": []interface{}{
+						map[string]interface{}{"name": "rootdisk", "containerDisk": map[string]interface{}{"image": "fedora:40"}},
+						map[string]interface{}{"name": "cloudinit", "cloudInitNoCloud": map[string]interface{}{}},
+					},
+				},
+			},
+		},
+	}}
+
+	obj, err = getImagesFromCustomResource(&configs[1])(vm)
+	require.NoError(t, err)
+
+	cis = obj.(*controllerWithContainerInfos)
+	require.True(t, cis.enabled)
+	require.Equal(t, map[string]containerImage{
+		"rootdisk": {image: "fedora:40", containerType: store.ContainerTypeRegular},
+	}, cis.containerToImages)
+}
@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	// verifiedBlobTTL limits how long a verified blob is trusted, as it may be garbage collected later.
+	verifiedBlobTTL = time.Hour
+	// blobCachePruneSize is the number of cached blobs above which expired entries are dropped.
+	blobCachePruneSize = 100000
+)
+
+// deepCheckSelector selects images whose blobs are verified, by the registry host or by the image name.
+type deepCheckSelector struct {
+	registries []string
+	images     []regexp.Regexp
+}
+
+func (s deepCheckSelector) selects(image, registry string) bool {
+	if slices.Contains(s.registries, registry) {
+		return true
+	}
+
+	return slices.ContainsFunc(s.images, func(re regexp.Regexp) bool { return re.MatchString(image) })
+}
+
+// blobCache remembers blobs that were found in a repository, so that base layers shared by many images are not
+// verified again and again. It is safe for concurrent use.
+type blobCache struct {
+	lock     sync.Mutex
+	verified map[string]time.Time
+	ttl      time.Duration
+}
+
+func newBlobCache(ttl time.Duration) *blobCache {
+	return &blobCache{
+		verified: make(map[string]time.Time),
+		ttl:      ttl,
+	}
+}
+
+func blobCacheKey(repo name.Repository, digest v1.Hash) string {
+	return repo.Name() + "@" + digest.String()
+}
+
+func (c *blobCache) has(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	verifiedAt, ok := c.verified[key]
+
+	return ok && time.Since(verifiedAt) < c.ttl
+}
+
+func (c *blobCache) add(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.verified) >= blobCachePruneSize {
+		for k, verifiedAt := range c.verified {
+			if time.Since(verifiedAt) >= c.ttl {
+				delete(c.verified, k)
+			}
+		}
+	}
+
+	c.verified[key] = time.Now()
+}
+
+// missingBlobs fetches the manifests of the image for the given platforms, or for all platforms of an index if none
+// are given, and returns digests of the config and layer blobs the repository does not have.
+func missingBlobs(ref name.Reference, desc *v1.Descriptor, platforms []v1.Platform, blobs *blobCache, opts ...remote.Option) ([]string, error) {
+	repo := ref.Context()
+
+	manifestDigests := []v1.Hash{desc.Digest}
+	if desc.MediaType.IsIndex() {
+		var indexManifest *v1.IndexManifest
+		err := withRequestTimeout(opts, func(opts ...remote.Option) error {
+			index, err := remote.Index(repo.Digest(desc.Digest.String()), opts...)
+			if err != nil {
+				return err
+			}
+			indexManifest, err = index.IndexManifest()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		manifestDigests = nil
+		for _, manifest := range indexManifest.Manifests {
+			if relevantPlatform(manifest.Platform, platforms) {
+				manifestDigests = append(manifestDigests, manifest.Digest)
+			}
+		}
+	}
+
+	var missing []string
+	for _, manifestDigest := range manifestDigests {
+		var manifest *v1.Manifest
+		err := withRequestTimeout(opts, func(opts ...remote.Option) error {
+			img, err := remote.Image(repo.Digest(manifestDigest.String()), opts...)
+			if err != nil {
+				return err
+			}
+			manifest, err = img.Manifest()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		blobDescs := append([]v1.Descriptor{manifest.Config}, manifest.Layers...)
+		for _, blobDesc := range blobDescs {
+			// Foreign layers are pulled from their own URLs rather than from the registry.
+			if !blobDesc.MediaType.IsDistributable() || len(blobDesc.URLs) > 0 {
+				continue
+			}
+
+			key := blobCacheKey(repo, blobDesc.Digest)
+			if blobs.has(key) {
+				continue
+			}
+
+			var found bool
+			err := withRequestTimeout(opts, func(opts ...remote.Option) (err error) {
+				found, err = blobExists(repo, blobDesc.Digest, opts...)
+				return
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				missing = append(missing, blobDesc.Digest.String())
+				continue
+			}
+
+			blobs.add(key)
+		}
+	}
+	slices.Sort(missing)
+
+	return slices.Compact(missing), nil
+}
+
+// relevantPlatform reports whether a manifest of an index is pulled on any of the platforms. Manifests without
+// a platform and attestations (the "unknown/unknown" platform) are never pulled by themselves.
+func relevantPlatform(platform *v1.Platform, platforms []v1.Platform) bool {
+	if platform == nil || platform.OS == "unknown" {
+		return false
+	}
+
+	if len(platforms) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(platforms, func(p v1.Platform) bool { return platformSatisfies(*platform, p) })
+}
+
+func blobExists(repo name.Repository, digest v1.Hash, opts ...remote.Option) (bool, error) {
+	layer, err := remote.Layer(repo.Digest(digest.String()), opts...)
+	if err != nil {
+		return false, err
+	}
+
+	// Size issues a HEAD request for the blob.
+	_, err = layer.Size()
+
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func blobMissingError(missing []string) error {
+	return fmt.Errorf("registry has no blobs referenced by the image manifest: %s", strings.Join(missing, ", "))
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+type blobHeadCounter struct {
+	http.RoundTripper
+	heads atomic.Int32
+}
+
+func (c *blobHeadCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead && strings.Contains(req.URL.Path, "/blobs/") {
+		c.heads.Add(1)
+	}
+
+	return c.RoundTripper.RoundTrip(req)
+}
+
+func Test_checkBlobs(t *testing.T) {
+	blobHandler := ggcrregistry.NewInMemoryBlobHandler()
+	server := httptest.NewServer(ggcrregistry.New(
+		ggcrregistry.Logger(log.New(io.Discard, "", 0)),
+		ggcrregistry.WithBlobHandler(blobHandler),
+	))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	push := func(image string) (string, []string) {
+		t.Helper()
+
+		ref, err := parseImageName(host+"/"+image, "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+
+		layers, err := img.Layers()
+		require.NoError(t, err)
+
+		var digests []string
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			require.NoError(t, err)
+			digests = append(digests, digest.String())
+		}
+
+		return ref.String(), digests
+	}
+
+	complete, _ := push("test/complete:latest")
+	broken, layers := push("test/broken:latest")
+
+	// Emulate a garbage collection that removed a layer still referenced by the manifest.
+	missingLayer, err := v1.NewHash(layers[1])
+	require.NoError(t, err)
+	require.NoError(t, blobHandler.(ggcrregistry.BlobDeleteHandler).Delete(context.Background(), "test/broken", missingLayer))
+
+	counter := &blobHeadCounter{RoundTripper: http.DefaultTransport}
+	blobs := newBlobCache(time.Hour)
+
+	checkImage := func(image string) (store.CheckResult, error) {
+		t.Helper()
+
+		ref, err := parseImageName(image, "", true)
+		require.NoError(t, err)
+
+		return check(ref, nil, counter, checkOptions{blobs: blobs})
+	}
+
+	result, _ := checkImage(complete)
+	require.Equal(t, store.Available, result.AvailMode)
+	// The config and both layers are verified.
+	require.Equal(t, int32(3), counter.heads.Load())
+
+	result, _ = checkImage(complete)
+	require.Equal(t, store.Available, result.AvailMode)
+	require.Equal(t, int32(3), counter.heads.Load(), "verified blobs are cached")
+
+	result, err = checkImage(broken)
+	require.Equal(t, store.BlobMissing, result.AvailMode)
+	require.Equal(t, ReasonBlobMissing, result.Reason)
+	require.Equal(t, []string{layers[1]}, result.MissingBlobs)
+	require.ErrorContains(t, err, layers[1])
+
+	t.Run("request timeout", func(t *testing.T) {
+		ref, err := parseImageName(complete, "", true)
+		require.NoError(t, err)
+
+		// The context of the whole check is over, the request has its own one.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = withRequestTimeout([]remote.Option{remote.WithContext(ctx)}, func(opts ...remote.Option) error {
+			_, err := remote.Head(ref, opts...)
+			return err
+		})
+		require.NoError(t, err)
+	})
+}
@@ -1,8 +1,13 @@
 package registry
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"net"
 	"net/http"
+	"syscall"
 
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
@@ -19,6 +24,85 @@ func IsAbsent(err error) bool {
 	return transpErr.StatusCode == http.StatusNotFound
 }
 
+// IsRepositoryAbsent reports whether the registry does not know the repository, e.g., due to a typo in its name.
+func IsRepositoryAbsent(err error) bool {
+	return hasErrorCode(err, transport.NameUnknownErrorCode)
+}
+
+// IsManifestAbsent reports whether the repository exists, but the tag or digest does not.
+func IsManifestAbsent(err error) bool {
+	return hasErrorCode(err, transport.ManifestUnknownErrorCode)
+}
+
+func IsBadRepositoryName(err error) bool {
+	return hasErrorCode(err, transport.NameInvalidErrorCode)
+}
+
+func IsBadTag(err error) bool {
+	return hasErrorCode(err, transport.TagInvalidErrorCode)
+}
+
+// NeedsErrorBody reports whether the error is a HEAD response that may be refined with the error codes
+// of the response body, which HEAD responses lack.
+func NeedsErrorBody(err error) bool {
+	var transpErr *transport.Error
+	errors.As(err, &transpErr)
+
+	if transpErr == nil {
+		return false
+	}
+
+	return len(transpErr.Errors) == 0 &&
+		(transpErr.StatusCode == http.StatusNotFound || transpErr.StatusCode == http.StatusBadRequest)
+}
+
+func hasErrorCode(err error, code transport.ErrorCode) bool {
+	var transpErr *transport.Error
+	errors.As(err, &transpErr)
+
+	if transpErr == nil {
+		return false
+	}
+
+	for _, diagnostic := range transpErr.Errors {
+		if diagnostic.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsPullBlocked reports whether the registry denied the pull by a policy, e.g., Harbor responds with 412 Precondition
+// Failed to pulls of vulnerable or unsigned images. Only the manifest GET that emulates a pull is classified, a 403
+// response to it counts too, because it only happens after a HEAD request with the same credentials succeeded.
+func IsPullBlocked(err error) bool {
+	var pullErr *pullError
+	if !errors.As(err, &pullErr) {
+		return false
+	}
+
+	var transpErr *transport.Error
+	errors.As(pullErr, &transpErr)
+
+	if transpErr == nil {
+		return false
+	}
+
+	return transpErr.StatusCode == http.StatusPreconditionFailed || transpErr.StatusCode == http.StatusForbidden
+}
+
+func IsRateLimited(err error) bool {
+	var transpErr *transport.Error
+	errors.As(err, &transpErr)
+
+	if transpErr == nil {
+		return false
+	}
+
+	return transpErr.StatusCode == http.StatusTooManyRequests || hasErrorCode(err, transport.TooManyRequestsErrorCode)
+}
+
 func IsAuthnFail(err error) bool {
 	var transpErr *transport.Error
 	errors.As(err, &transpErr)
@@ -44,3 +128,91 @@ func IsAuthzFail(err error) bool {
 func IsOldRegistry(err error) bool {
 	return errors.Is(err, remote.ErrSchema1)
 }
+
+// Reasons of the registry unavailability.
+const (
+	ReasonDNS     = "dns"
+	ReasonTCP     = "tcp"
+	ReasonTLS     = "tls"
+	ReasonTimeout = "timeout"
+	ReasonHTTP5xx = "http_5xx"
+)
+
+// Reasons of failures that come with unbounded details, e.g., registry messages or digests, which are logged instead.
+const (
+	ReasonPolicy      = "policy"
+	ReasonBlobMissing = "blob_missing"
+)
+
+// UnavailabilityReason classifies network failures and server errors that make the registry unavailable.
+// An empty string is returned if the error is not caused by the registry unavailability.
+func UnavailabilityReason(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var transpErr *transport.Error
+	if errors.As(err, &transpErr) {
+		if transpErr.StatusCode >= http.StatusInternalServerError {
+			return ReasonHTTP5xx
+		}
+		return ""
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ReasonTimeout
+		}
+		return ReasonDNS
+	}
+
+	if isTLSError(err) {
+		return ReasonTLS
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) {
+		return ReasonTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ReasonTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) {
+		return ReasonTCP
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ReasonTCP
+	}
+
+	return ""
+}
+
+func isTLSError(err error) bool {
+	var (
+		recordHeaderErr   tls.RecordHeaderError
+		alertErr          tls.AlertError
+		verificationErr   *tls.CertificateVerificationError
+		unknownAuthErr    x509.UnknownAuthorityError
+		hostnameErr       x509.HostnameError
+		certInvalidErr    x509.CertificateInvalidError
+		systemRootsErr    x509.SystemRootsError
+		insecureAlgoErr   x509.InsecureAlgorithmError
+		constraintViolErr x509.ConstraintViolationError
+	)
+
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certInvalidErr) ||
+		errors.As(err, &systemRootsErr) ||
+		errors.As(err, &insecureAlgoErr) ||
+		errors.As(err, &constraintViolErr)
+}
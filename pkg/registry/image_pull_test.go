@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UnavailabilityReason(t *testing.T) {
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Head", URL: "https://registry.example.com/v2/", Err: err}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{name: "no error", err: nil, reason: ""},
+		{name: "dns", err: urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "registry.example.com", IsNotFound: true}}), reason: ReasonDNS},
+		{name: "connection refused", err: urlErr(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), reason: ReasonTCP},
+		{name: "tls", err: urlErr(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), reason: ReasonTLS},
+		{name: "timeout", err: urlErr(context.DeadlineExceeded), reason: ReasonTimeout},
+		{name: "http 503", err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, reason: ReasonHTTP5xx},
+		{name: "http 404", err: &transport.Error{StatusCode: http.StatusNotFound}, reason: ""},
+		{name: "unknown", err: errors.New("unexpected"), reason: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.reason, UnavailabilityReason(tc.err))
+		})
+	}
+}
+
+func Test_IsPullBlocked(t *testing.T) {
+	get := &http.Request{Method: http.MethodGet}
+
+	for _, tc := range []struct {
+		name    string
+		err     error
+		blocked bool
+	}{
+		{name: "policy", err: &pullError{err: &transport.Error{StatusCode: http.StatusPreconditionFailed, Request: get}}, blocked: true},
+		{name: "forbidden pull", err: &pullError{err: &transport.Error{StatusCode: http.StatusForbidden, Request: get}}, blocked: true},
+		{name: "forbidden token or blob GET", err: &transport.Error{StatusCode: http.StatusForbidden, Request: get}, blocked: false},
+		{name: "missing manifest", err: &pullError{err: &transport.Error{StatusCode: http.StatusNotFound, Request: get}}, blocked: false},
+		{name: "no error", err: nil, blocked: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.blocked, IsPullBlocked(tc.err))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package registry
 import (
 	"fmt"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/flant/k8s-image-availability-exporter/pkg/store"
@@ -11,50 +12,97 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	imageIndexName     = "image"
 	labeledNSIndexName = "labeledNS"
+
+	// maxOwnerChainDepth guards owner resolution against reference loops.
+	maxOwnerChainDepth = 8
 )
 
 type ControllerIndexers struct {
-	namespaceIndexer                  cache.Indexer
-	serviceAccountIndexer             cache.Indexer
-	deploymentIndexer                 cache.Indexer
-	statefulSetIndexer                cache.Indexer
-	daemonSetIndexer                  cache.Indexer
-	cronJobIndexer                    cache.Indexer
+	namespaceIndexer             cache.Indexer
+	serviceAccountIndexer        cache.Indexer
+	deploymentIndexer            cache.Indexer
+	statefulSetIndexer           cache.Indexer
+	daemonSetIndexer             cache.Indexer
+	cronJobIndexer               cache.Indexer
+	jobIndexer                   cache.Indexer
+	replicaSetIndexer            cache.Indexer
+	replicationControllerIndexer cache.Indexer
+	podIndexer                   cache.Indexer
+	customResourceIndexers       map[schema.GroupVersionResource]cache.Indexer
+	// customResourceKinds maps kinds of custom resources to their resources, so that owner references can be resolved.
+	customResourceKinds               map[schema.GroupKind]schema.GroupVersionResource
+	controllerRevisionIndexer         cache.Indexer
 	secretIndexer                     cache.Indexer
+	nodeIndexer                       cache.Indexer
 	forceCheckDisabledControllerKinds []string
+	rollbackRevisions                 int
+}
+
+type containerImage struct {
+	image         string
+	containerType string
 }
 
 type controllerWithContainerInfos struct {
 	metav1.ObjectMeta
 	controllerKind       string
-	containerToImages    map[string]string
+	containerToImages    map[string]containerImage
+	volumeToImages       map[string]string
 	pullSecretReferences []corev1.LocalObjectReference
 	serviceAccountName   string
+	placement            nodePlacement
 	enabled              bool
+	// revision is set for ReplicaSets of Deployments and for ControllerRevisions.
+	revision int64
 }
 
 var (
 	imageIndexers = cache.Indexers{
 		imageIndexName: func(obj interface{}) (images []string, err error) {
-			for _, v := range obj.(*controllerWithContainerInfos).containerToImages {
-				images = append(images, v)
-			}
-			return
+			return obj.(*controllerWithContainerInfos).images(), nil
 		},
 	}
 )
 
+// images returns images of all containers and image volumes of the controller.
+func (cis *controllerWithContainerInfos) images() (ret []string) {
+	for _, v := range cis.containerToImages {
+		ret = append(ret, v.image)
+	}
+	for _, v := range cis.volumeToImages {
+		ret = append(ret, v)
+	}
+
+	return
+}
+
+// runsImage reports whether a container of the controller runs the image, as opposed to mounting it as an image volume.
+func (cis *controllerWithContainerInfos) runsImage(image string) bool {
+	for _, container := range cis.containerToImages {
+		if container.image == image {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (ci ControllerIndexers) validCi(cis *controllerWithContainerInfos) bool {
 	if !cis.enabled && !slices.Contains(ci.forceCheckDisabledControllerKinds, strings.ToLower(cis.controllerKind)) {
 		return false
 	}
 
+	return ci.inLabeledNamespace(cis)
+}
+
+func (ci ControllerIndexers) inLabeledNamespace(cis *controllerWithContainerInfos) bool {
 	nsList, _ := ci.namespaceIndexer.ByIndex(labeledNSIndexName, cis.Namespace)
 
 	return len(nsList) != 0
@@ -93,8 +141,10 @@ func getImagesFromDeployment(obj interface{}) (interface{}, error) {
 	return &controllerWithContainerInfos{
 		ObjectMeta:           deploymentCopy.ObjectMeta,
 		controllerKind:       "Deployment",
-		containerToImages:    extractImagesFromContainers(deploymentCopy.Spec.Template.Spec.Containers),
+		containerToImages:    extractImagesFromPodSpec(&deploymentCopy.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(deploymentCopy.Spec.Template.Spec.Volumes),
 		pullSecretReferences: deploymentCopy.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&deploymentCopy.Spec.Template.Spec),
 		serviceAccountName:   deploymentCopy.Spec.Template.Spec.ServiceAccountName,
 		enabled:              *deploymentCopy.Spec.Replicas > 0,
 	}, nil
@@ -112,8 +162,10 @@ func getImagesFromStatefulSet(obj interface{}) (interface{}, error) {
 	return &controllerWithContainerInfos{
 		ObjectMeta:           statefulSetCopy.ObjectMeta,
 		controllerKind:       "StatefulSet",
-		containerToImages:    extractImagesFromContainers(statefulSetCopy.Spec.Template.Spec.Containers),
+		containerToImages:    extractImagesFromPodSpec(&statefulSetCopy.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(statefulSetCopy.Spec.Template.Spec.Volumes),
 		pullSecretReferences: statefulSetCopy.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&statefulSetCopy.Spec.Template.Spec),
 		serviceAccountName:   statefulSetCopy.Spec.Template.Spec.ServiceAccountName,
 		enabled:              *statefulSetCopy.Spec.Replicas > 0,
 	}, nil
@@ -131,8 +183,10 @@ func getImagesFromDaemonSet(obj interface{}) (interface{}, error) {
 	return &controllerWithContainerInfos{
 		ObjectMeta:           daemonSetCopy.ObjectMeta,
 		controllerKind:       "DaemonSet",
-		containerToImages:    extractImagesFromContainers(daemonSetCopy.Spec.Template.Spec.Containers),
+		containerToImages:    extractImagesFromPodSpec(&daemonSetCopy.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(daemonSetCopy.Spec.Template.Spec.Volumes),
 		pullSecretReferences: daemonSetCopy.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&daemonSetCopy.Spec.Template.Spec),
 		serviceAccountName:   daemonSetCopy.Spec.Template.Spec.ServiceAccountName,
 		enabled:              daemonSetCopy.Status.CurrentNumberScheduled > 0,
 	}, nil
@@ -150,18 +204,157 @@ func getImagesFromCronJob(obj interface{}) (interface{}, error) {
 	return &controllerWithContainerInfos{
 		ObjectMeta:           cronJobCopy.ObjectMeta,
 		controllerKind:       "CronJob",
-		containerToImages:    extractImagesFromContainers(cronJobCopy.Spec.JobTemplate.Spec.Template.Spec.Containers),
+		containerToImages:    extractImagesFromPodSpec(&cronJobCopy.Spec.JobTemplate.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(cronJobCopy.Spec.JobTemplate.Spec.Template.Spec.Volumes),
 		pullSecretReferences: cronJobCopy.Spec.JobTemplate.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&cronJobCopy.Spec.JobTemplate.Spec.Template.Spec),
 		serviceAccountName:   cronJobCopy.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName,
 		enabled:              !*cronJobCopy.Spec.Suspend,
 	}, nil
 }
 
-func extractImagesFromContainers(containers []corev1.Container) map[string]string {
+func getImagesFromJob(obj interface{}) (interface{}, error) {
+	if cis, ok := obj.(*controllerWithContainerInfos); ok {
+		return cis, nil
+	}
+
+	job := obj.(*batchv1.Job)
+
+	jobCopy := job.DeepCopy()
+
+	return &controllerWithContainerInfos{
+		ObjectMeta:           jobCopy.ObjectMeta,
+		controllerKind:       "Job",
+		containerToImages:    extractImagesFromPodSpec(&jobCopy.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(jobCopy.Spec.Template.Spec.Volumes),
+		pullSecretReferences: jobCopy.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&jobCopy.Spec.Template.Spec),
+		serviceAccountName:   jobCopy.Spec.Template.Spec.ServiceAccountName,
+		enabled:              (jobCopy.Spec.Suspend == nil || !*jobCopy.Spec.Suspend) && !isJobFinished(jobCopy),
+	}, nil
+}
+
+func getImagesFromReplicaSet(obj interface{}) (interface{}, error) {
+	if cis, ok := obj.(*controllerWithContainerInfos); ok {
+		return cis, nil
+	}
+
+	replicaSet := obj.(*appsv1.ReplicaSet)
+
+	replicaSetCopy := replicaSet.DeepCopy()
+
+	return &controllerWithContainerInfos{
+		ObjectMeta:           replicaSetCopy.ObjectMeta,
+		controllerKind:       "ReplicaSet",
+		containerToImages:    extractImagesFromPodSpec(&replicaSetCopy.Spec.Template.Spec),
+		volumeToImages:       extractImagesFromVolumes(replicaSetCopy.Spec.Template.Spec.Volumes),
+		pullSecretReferences: replicaSetCopy.Spec.Template.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&replicaSetCopy.Spec.Template.Spec),
+		serviceAccountName:   replicaSetCopy.Spec.Template.Spec.ServiceAccountName,
+		enabled:              replicaSetCopy.Spec.Replicas == nil || *replicaSetCopy.Spec.Replicas > 0,
+		revision:             replicaSetRevision(replicaSetCopy),
+	}, nil
+}
+
+func getImagesFromReplicationController(obj interface{}) (interface{}, error) {
+	if cis, ok := obj.(*controllerWithContainerInfos); ok {
+		return cis, nil
+	}
+
+	replicationController := obj.(*corev1.ReplicationController)
+
+	replicationControllerCopy := replicationController.DeepCopy()
+
+	// The pod template is optional for ReplicationControllers.
+	var podSpec corev1.PodSpec
+	if replicationControllerCopy.Spec.Template != nil {
+		podSpec = replicationControllerCopy.Spec.Template.Spec
+	}
+
+	return &controllerWithContainerInfos{
+		ObjectMeta:           replicationControllerCopy.ObjectMeta,
+		controllerKind:       "ReplicationController",
+		containerToImages:    extractImagesFromPodSpec(&podSpec),
+		volumeToImages:       extractImagesFromVolumes(podSpec.Volumes),
+		pullSecretReferences: podSpec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&podSpec),
+		serviceAccountName:   podSpec.ServiceAccountName,
+		enabled:              replicationControllerCopy.Spec.Replicas == nil || *replicationControllerCopy.Spec.Replicas > 0,
+	}, nil
+}
+
+func getImagesFromPod(obj interface{}) (interface{}, error) {
+	if cis, ok := obj.(*controllerWithContainerInfos); ok {
+		return cis, nil
+	}
+
+	pod := obj.(*corev1.Pod)
+
+	podCopy := pod.DeepCopy()
+
+	return &controllerWithContainerInfos{
+		ObjectMeta:           podCopy.ObjectMeta,
+		controllerKind:       "Pod",
+		containerToImages:    extractImagesFromPodSpec(&podCopy.Spec),
+		volumeToImages:       extractImagesFromVolumes(podCopy.Spec.Volumes),
+		pullSecretReferences: podCopy.Spec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&podCopy.Spec),
+		serviceAccountName:   podCopy.Spec.ServiceAccountName,
+		enabled:              podCopy.Status.Phase != corev1.PodSucceeded && podCopy.Status.Phase != corev1.PodFailed,
+	}, nil
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractImagesFromPodSpec collects images of all containers in the pod spec. Container names are unique
+// across regular, init and ephemeral containers, so they can safely share the same map.
+func extractImagesFromPodSpec(spec *corev1.PodSpec) map[string]containerImage {
+	ret := make(map[string]containerImage)
+
+	for _, container := range spec.InitContainers {
+		containerType := store.ContainerTypeInit
+		// Native sidecars are init containers that keep running alongside the regular ones.
+		if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			containerType = store.ContainerTypeSidecar
+		}
+
+		ret[container.Name] = containerImage{image: container.Image, containerType: containerType}
+	}
+
+	for _, container := range spec.Containers {
+		ret[container.Name] = containerImage{image: container.Image, containerType: store.ContainerTypeRegular}
+	}
+
+	for _, container := range spec.EphemeralContainers {
+		ret[container.Name] = containerImage{image: container.Image, containerType: store.ContainerTypeEphemeral}
+	}
+
+	return ret
+}
+
+// extractImagesFromVolumes collects references of OCI artifacts mounted as image volumes.
+func extractImagesFromVolumes(volumes []corev1.Volume) map[string]string {
 	ret := make(map[string]string)
 
-	for _, container := range containers {
-		ret[container.Name] = container.Image
+	for _, volume := range volumes {
+		if volume.Image == nil || volume.Image.Reference == "" {
+			continue
+		}
+
+		// With the Never pull policy the artifact has to be present on the node, the registry is never contacted.
+		if volume.Image.PullPolicy == corev1.PullNever {
+			continue
+		}
+
+		ret[volume.Name] = volume.Image.Reference
 	}
 
 	return ret
@@ -215,8 +408,137 @@ func (ci ControllerIndexers) ExtractPullSecretRefs(obj interface{}) (ret []strin
 	return
 }
 
+func (ci ControllerIndexers) controllerIndexers() []cache.Indexer {
+	indexers := []cache.Indexer{
+		ci.deploymentIndexer,
+		ci.statefulSetIndexer,
+		ci.daemonSetIndexer,
+		ci.cronJobIndexer,
+		ci.jobIndexer,
+		ci.replicaSetIndexer,
+		ci.replicationControllerIndexer,
+		ci.podIndexer,
+	}
+
+	if ci.controllerRevisionIndexer != nil {
+		indexers = append(indexers, ci.controllerRevisionIndexer)
+	}
+
+	for _, indexer := range ci.customResourceIndexers {
+		indexers = append(indexers, indexer)
+	}
+
+	return indexers
+}
+
+// indexerForOwner returns the indexer of the owner kind, custom resources are looked up by their API group as well,
+// as different groups may have resources of the same kind.
+func (ci ControllerIndexers) indexerForOwner(ownerRef *metav1.OwnerReference) cache.Indexer {
+	switch ownerRef.Kind {
+	case "Deployment":
+		return ci.deploymentIndexer
+	case "StatefulSet":
+		return ci.statefulSetIndexer
+	case "DaemonSet":
+		return ci.daemonSetIndexer
+	case "CronJob":
+		return ci.cronJobIndexer
+	case "Job":
+		return ci.jobIndexer
+	case "ReplicaSet":
+		return ci.replicaSetIndexer
+	case "ReplicationController":
+		return ci.replicationControllerIndexer
+	case "Pod":
+		return ci.podIndexer
+	default:
+		gv, err := schema.ParseGroupVersion(ownerRef.APIVersion)
+		if err != nil {
+			return nil
+		}
+
+		gvr, ok := ci.customResourceKinds[schema.GroupKind{Group: gv.Group, Kind: ownerRef.Kind}]
+		if !ok {
+			return nil
+		}
+
+		return ci.customResourceIndexers[gvr]
+	}
+}
+
+// resolveTopLevelOwner follows controller ownerReferences up to the outermost owner, so that a Pod created by
+// a ReplicaSet of a Deployment is reported under the Deployment. The chain stops at the first owner that is
+// not watched by the exporter, and that owner is reported instead.
+func (ci ControllerIndexers) resolveTopLevelOwner(cis *controllerWithContainerInfos) (kind, name string) {
+	kind, name = cis.controllerKind, cis.Name
+
+	objMeta := &cis.ObjectMeta
+	for i := 0; i < maxOwnerChainDepth; i++ {
+		ownerRef := metav1.GetControllerOfNoCopy(objMeta)
+		if ownerRef == nil {
+			return
+		}
+		kind, name = ownerRef.Kind, ownerRef.Name
+
+		indexer := ci.indexerForOwner(ownerRef)
+		if indexer == nil {
+			return
+		}
+
+		ownerRaw, exists, err := indexer.GetByKey(cis.Namespace + "/" + ownerRef.Name)
+		if err != nil {
+			logrus.Warn(err)
+			return
+		}
+		if !exists {
+			return
+		}
+
+		owner := ownerRaw.(*controllerWithContainerInfos)
+		if owner.UID != ownerRef.UID {
+			return
+		}
+		objMeta = &owner.ObjectMeta
+	}
+
+	return
+}
+
+// coveredByOwner reports whether the controller owner of the object is watched and runs all of its images,
+// e.g., a Pod of a ReplicaSet. Images of old ReplicaSets kept for a rollback are not covered by the Deployment.
+func (ci ControllerIndexers) coveredByOwner(cis *controllerWithContainerInfos) bool {
+	ownerRef := metav1.GetControllerOfNoCopy(&cis.ObjectMeta)
+	if ownerRef == nil {
+		return false
+	}
+
+	indexer := ci.indexerForOwner(ownerRef)
+	if indexer == nil {
+		return false
+	}
+
+	ownerRaw, exists, err := indexer.GetByKey(cis.Namespace + "/" + ownerRef.Name)
+	if err != nil || !exists {
+		return false
+	}
+
+	owner := ownerRaw.(*controllerWithContainerInfos)
+	if owner.UID != ownerRef.UID {
+		return false
+	}
+
+	ownerImages := owner.images()
+	for _, image := range cis.images() {
+		if !slices.Contains(ownerImages, image) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (ci ControllerIndexers) GetObjectsByImageIndex(image string) (ret []interface{}) {
-	for _, indexer := range []cache.Indexer{ci.deploymentIndexer, ci.statefulSetIndexer, ci.daemonSetIndexer, ci.cronJobIndexer} {
+	for _, indexer := range ci.controllerIndexers() {
 		objs, err := indexer.ByIndex(imageIndexName, image)
 		if err != nil {
 			panic(err)
@@ -228,45 +550,116 @@ func (ci ControllerIndexers) GetObjectsByImageIndex(image string) (ret []interfa
 	return
 }
 
-func (ci ControllerIndexers) GetContainerInfosForImage(image string) (ret []store.ContainerInfo) {
+// GetContainerInfosForImage returns container infos of the image grouped by the credential set of their workloads,
+// see store.ImageKey.
+func (ci ControllerIndexers) GetContainerInfosForImage(image string) map[string][]store.ContainerInfo {
 	objs := ci.GetObjectsByImageIndex(image)
 
+	// Pods resolve to the same top-level owner as their controller, but may carry other pull secrets, e.g., ones injected
+	// by an admission webhook. A container is reported under a single credential set, the one of the object that is
+	// the top-level owner itself is preferred, the lowest one otherwise, so that the choice does not depend on the order.
+	type credentialSet struct {
+		credentials string
+		topLevel    bool
+	}
+	sets := make(map[store.ContainerInfo]credentialSet)
+	preferred := func(set, other credentialSet) bool {
+		if set.topLevel != other.topLevel {
+			return set.topLevel
+		}
+		return set.credentials < other.credentials
+	}
+	add := func(info store.ContainerInfo, set credentialSet) {
+		if other, ok := sets[info]; !ok || preferred(set, other) {
+			sets[info] = set
+		}
+	}
+
 	for _, obj := range objs {
 		controllerWithInfos := obj.(*controllerWithContainerInfos)
-		if !ci.validCi(controllerWithInfos) {
+
+		current := ci.validCi(controllerWithInfos)
+		revision, rollback := ci.rollbackRevision(controllerWithInfos)
+		if rollback {
+			rollback = ci.inLabeledNamespace(controllerWithInfos)
+		}
+		if !current && !rollback {
 			continue
 		}
 
+		controllerKind, controllerName := ci.resolveTopLevelOwner(controllerWithInfos)
+
+		var infos []store.ContainerInfo
 		for k, v := range controllerWithInfos.containerToImages {
-			if v != image {
+			if v.image != image {
 				continue
 			}
 
-			ret = append(ret, store.ContainerInfo{
+			infos = append(infos, store.ContainerInfo{
 				Namespace:      controllerWithInfos.Namespace,
-				ControllerKind: controllerWithInfos.controllerKind,
-				ControllerName: controllerWithInfos.Name,
+				ControllerKind: controllerKind,
+				ControllerName: controllerName,
 				Container:      k,
+				ContainerType:  v.containerType,
+			})
+		}
+
+		for k, v := range controllerWithInfos.volumeToImages {
+			if v != image {
+				continue
+			}
+
+			infos = append(infos, store.ContainerInfo{
+				Namespace:      controllerWithInfos.Namespace,
+				ControllerKind: controllerKind,
+				ControllerName: controllerName,
+				Volume:         k,
 			})
 		}
+
+		if len(infos) == 0 {
+			continue
+		}
+
+		set := credentialSet{
+			credentials: credentialsKey(ci.ExtractPullSecretRefs(obj)),
+			topLevel:    controllerKind == controllerWithInfos.controllerKind && controllerName == controllerWithInfos.Name,
+		}
+		for _, info := range infos {
+			if current {
+				add(info, set)
+			}
+			if rollback {
+				info.Revision = strconv.FormatInt(revision, 10)
+				add(info, set)
+			}
+		}
 	}
 
-	return
+	ret := make(map[string][]store.ContainerInfo)
+	for info, set := range sets {
+		ret[set.credentials] = append(ret[set.credentials], info)
+	}
+
+	return ret
 }
 
-func (ci ControllerIndexers) GetImagePullSecrets(image string) []corev1.Secret {
-	objs := ci.GetObjectsByImageIndex(image)
+// credentialsKey returns the credential set of the pull secret references, see store.ImageKey.
+func credentialsKey(refs []string) string {
+	refs = slices.Clone(refs)
+	slices.Sort(refs)
 
-	var refSet = map[string]struct{}{}
-	for _, obj := range objs {
-		pullSecretRefs := ci.ExtractPullSecretRefs(obj)
-		for _, ref := range pullSecretRefs {
-			refSet[ref] = struct{}{}
-		}
+	return strings.Join(slices.Compact(refs), ",")
+}
+
+// GetPullSecrets returns the existing pull secrets of the credential set, see store.ImageKey.
+func (ci ControllerIndexers) GetPullSecrets(credentials string) []corev1.Secret {
+	if credentials == "" || ci.secretIndexer == nil {
+		return nil
 	}
 
 	var dereferencedPullSecrets []corev1.Secret
-	for ref := range refSet {
+	for _, ref := range strings.Split(credentials, ",") {
 		secretObj, exists, err := ci.secretIndexer.GetByKey(ref)
 		if err != nil {
 			panic(err)
@@ -274,12 +667,10 @@ func (ci ControllerIndexers) GetImagePullSecrets(image string) []corev1.Secret {
 		if !exists {
 			continue
 		}
-		secretPtr := secretObj.(*corev1.Secret)
+		// Providers may rewrite the secret data, which must not change the informer cache.
+		secretPtr := secretObj.(*corev1.Secret).DeepCopy()
 		dereferencedPullSecrets = append(dereferencedPullSecrets, *secretPtr)
 	}
 
-	if len(dereferencedPullSecrets) == 0 {
-		return nil
-	}
 	return dereferencedPullSecrets
 }
@@ -0,0 +1,241 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+)
+
+func Test_extractImagesFromPodSpec(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+
+	spec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "migrations", Image: "migrations:v1"},
+			{Name: "proxy", Image: "proxy:v1", RestartPolicy: &always},
+		},
+		Containers: []corev1.Container{
+			{Name: "app", Image: "app:v1"},
+		},
+		EphemeralContainers: []corev1.EphemeralContainer{
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox:latest"}},
+		},
+	}
+
+	require.Equal(t, map[string]containerImage{
+		"migrations": {image: "migrations:v1", containerType: store.ContainerTypeInit},
+		"proxy":      {image: "proxy:v1", containerType: store.ContainerTypeSidecar},
+		"app":        {image: "app:v1", containerType: store.ContainerTypeRegular},
+		"debugger":   {image: "busybox:latest", containerType: store.ContainerTypeEphemeral},
+	}, extractImagesFromPodSpec(spec))
+}
+
+func Test_resolveTopLevelOwner(t *testing.T) {
+	newIndexer := func(objs ...*controllerWithContainerInfos) cache.Indexer {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		for _, obj := range objs {
+			require.NoError(t, indexer.Add(obj))
+		}
+		return indexer
+	}
+
+	controllerRef := func(kind, name string, uid types.UID) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, UID: uid, Controller: ptr.To(true)}}
+	}
+
+	deployment := &controllerWithContainerInfos{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: "ns", Name: "app", UID: "deployment-uid"},
+		controllerKind: "Deployment",
+	}
+	replicaSet := &controllerWithContainerInfos{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns", Name: "app-5d4f8", UID: "replicaset-uid",
+			OwnerReferences: controllerRef("Deployment", "app", "deployment-uid"),
+		},
+		controllerKind: "ReplicaSet",
+	}
+	orphanReplicaSet := &controllerWithContainerInfos{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: "ns", Name: "orphan", UID: "orphan-uid"},
+		controllerKind: "ReplicaSet",
+	}
+
+	ci := ControllerIndexers{
+		deploymentIndexer: newIndexer(deployment),
+		replicaSetIndexer: newIndexer(replicaSet, orphanReplicaSet),
+	}
+
+	pod := func(ownerRefs []metav1.OwnerReference) *controllerWithContainerInfos {
+		return &controllerWithContainerInfos{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "ns", Name: "pod", OwnerReferences: ownerRefs},
+			controllerKind: "Pod",
+		}
+	}
+
+	kind, name := ci.resolveTopLevelOwner(pod(controllerRef("ReplicaSet", "app-5d4f8", "replicaset-uid")))
+	require.Equal(t, "Deployment", kind)
+	require.Equal(t, "app", name)
+
+	kind, name = ci.resolveTopLevelOwner(pod(controllerRef("ReplicaSet", "orphan", "orphan-uid")))
+	require.Equal(t, "ReplicaSet", kind)
+	require.Equal(t, "orphan", name)
+
+	kind, name = ci.resolveTopLevelOwner(pod(controllerRef("Rollout", "canary", "rollout-uid")))
+	require.Equal(t, "Rollout", kind)
+	require.Equal(t, "canary", name)
+
+	kind, name = ci.resolveTopLevelOwner(pod(nil))
+	require.Equal(t, "Pod", kind)
+	require.Equal(t, "pod", name)
+
+	t.Run("custom resources of the same kind in different groups", func(t *testing.T) {
+		argoRollouts := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+		otherRollouts := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "rollouts"}
+
+		application := &controllerWithContainerInfos{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "ns", Name: "app", UID: "application-uid"},
+			controllerKind: "Application",
+		}
+		argoRollout := &controllerWithContainerInfos{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", Name: "canary", UID: "rollout-uid",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Application", Name: "app", UID: "application-uid", Controller: ptr.To(true)}},
+			},
+			controllerKind: "Rollout",
+		}
+
+		ci := ControllerIndexers{
+			customResourceIndexers: map[schema.GroupVersionResource]cache.Indexer{
+				argoRollouts:  newIndexer(argoRollout),
+				otherRollouts: newIndexer(),
+				{Group: "example.com", Version: "v1", Resource: "applications"}: newIndexer(application),
+			},
+			customResourceKinds: map[schema.GroupKind]schema.GroupVersionResource{
+				{Group: "argoproj.io", Kind: "Rollout"}:     argoRollouts,
+				{Group: "example.com", Kind: "Rollout"}:     otherRollouts,
+				{Group: "example.com", Kind: "Application"}: {Group: "example.com", Version: "v1", Resource: "applications"},
+			},
+		}
+
+		ownerRef := func(apiVersion string) []metav1.OwnerReference {
+			return []metav1.OwnerReference{{APIVersion: apiVersion, Kind: "Rollout", Name: "canary", UID: "rollout-uid", Controller: ptr.To(true)}}
+		}
+
+		kind, name := ci.resolveTopLevelOwner(pod(ownerRef("argoproj.io/v1alpha1")))
+		require.Equal(t, "Application", kind)
+		require.Equal(t, "app", name)
+
+		// The rollout of the other group is not found, so the owner reference is reported as is.
+		kind, name = ci.resolveTopLevelOwner(pod(ownerRef("example.com/v1")))
+		require.Equal(t, "Rollout", kind)
+		require.Equal(t, "canary", name)
+	})
+}
+
+func Test_extractImagesFromVolumes(t *testing.T) {
+	volumes := []corev1.Volume{
+		{Name: "models", VolumeSource: corev1.VolumeSource{Image: &corev1.ImageVolumeSource{Reference: "models:v1", PullPolicy: corev1.PullIfNotPresent}}},
+		{Name: "preloaded", VolumeSource: corev1.VolumeSource{Image: &corev1.ImageVolumeSource{Reference: "preloaded:v1", PullPolicy: corev1.PullNever}}},
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}},
+	}
+
+	require.Equal(t, map[string]string{"models": "models:v1"}, extractImagesFromVolumes(volumes))
+}
+
+func Test_GetContainerInfosForImage_credentials(t *testing.T) {
+	newIndexer := func(indexers cache.Indexers, objs ...interface{}) cache.Indexer {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+		for _, obj := range objs {
+			require.NoError(t, indexer.Add(obj))
+		}
+		return indexer
+	}
+
+	workload := func(namespace, name, serviceAccount string, pullSecrets ...string) *controllerWithContainerInfos {
+		cis := &controllerWithContainerInfos{
+			ObjectMeta:         metav1.ObjectMeta{Namespace: namespace, Name: name},
+			controllerKind:     "Deployment",
+			containerToImages:  map[string]containerImage{"app": {image: "registry.test/app:v1", containerType: store.ContainerTypeRegular}},
+			serviceAccountName: serviceAccount,
+			enabled:            true,
+		}
+		for _, secret := range pullSecrets {
+			cis.pullSecretReferences = append(cis.pullSecretReferences, corev1.LocalObjectReference{Name: secret})
+		}
+		return cis
+	}
+
+	regcred := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "regcred"}}
+
+	// A pod of the deployment with a pull secret injected by an admission webhook.
+	pod := workload("a", "with-secret-7d4b9c-x2x5z", "", "regcred", "injected")
+	pod.controllerKind = "Pod"
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "Deployment", Name: "with-secret", Controller: ptr.To(true)}}
+
+	ci := ControllerIndexers{
+		namespaceIndexer: newIndexer(namespaceIndexers(""),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+		),
+		serviceAccountIndexer: newIndexer(cache.Indexers{},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "default"}},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "builder"}, ImagePullSecrets: []corev1.LocalObjectReference{{Name: "builder-cred"}}},
+		),
+		secretIndexer: newIndexer(cache.Indexers{}, regcred),
+		deploymentIndexer: newIndexer(imageIndexers,
+			workload("a", "with-secret", "", "regcred", "regcred"),
+			workload("b", "anonymous", ""),
+			workload("b", "service-account", "builder"),
+		),
+		statefulSetIndexer:           newIndexer(imageIndexers),
+		daemonSetIndexer:             newIndexer(imageIndexers),
+		cronJobIndexer:               newIndexer(imageIndexers),
+		jobIndexer:                   newIndexer(imageIndexers),
+		replicaSetIndexer:            newIndexer(imageIndexers),
+		replicationControllerIndexer: newIndexer(imageIndexers),
+		podIndexer:                   newIndexer(imageIndexers, pod),
+	}
+
+	infos := ci.GetContainerInfosForImage("registry.test/app:v1")
+	require.Len(t, infos, 3, "the container of the pod is reported under the credentials of its deployment only")
+	require.Len(t, infos["a/regcred"], 1)
+	require.Equal(t, "with-secret", infos["a/regcred"][0].ControllerName)
+	require.Equal(t, "anonymous", infos[""][0].ControllerName)
+	require.Equal(t, "service-account", infos["b/builder-cred"][0].ControllerName)
+
+	require.Equal(t, []corev1.Secret{*regcred}, ci.GetPullSecrets("a/regcred"))
+	require.Empty(t, ci.GetPullSecrets("b/builder-cred"), "missing secrets are skipped")
+	require.Empty(t, ci.GetPullSecrets(""))
+}
+
+func Test_coveredByOwner(t *testing.T) {
+	controllerRef := []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d4f8", UID: "replicaset-uid", Controller: ptr.To(true)}}
+
+	replicaSetIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, replicaSetIndexer.Add(&controllerWithContainerInfos{
+		ObjectMeta:        metav1.ObjectMeta{Namespace: "ns", Name: "app-5d4f8", UID: "replicaset-uid"},
+		controllerKind:    "ReplicaSet",
+		containerToImages: map[string]containerImage{"app": {image: "app:v1"}},
+	}))
+	ci := ControllerIndexers{replicaSetIndexer: replicaSetIndexer}
+
+	pod := func(ownerRefs []metav1.OwnerReference, image string) *controllerWithContainerInfos {
+		return &controllerWithContainerInfos{
+			ObjectMeta:        metav1.ObjectMeta{Namespace: "ns", Name: "pod", OwnerReferences: ownerRefs},
+			controllerKind:    "Pod",
+			containerToImages: map[string]containerImage{"app": {image: image}},
+		}
+	}
+
+	require.True(t, ci.coveredByOwner(pod(controllerRef, "app:v1")))
+	require.False(t, ci.coveredByOwner(pod(controllerRef, "app:v2")), "images the owner does not run")
+	require.False(t, ci.coveredByOwner(pod(nil, "app:v1")), "bare pod")
+	require.False(t, ci.coveredByOwner(pod([]metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d4f8", UID: "other-uid", Controller: ptr.To(true)}}, "app:v1")), "owner of the same name")
+	require.False(t, ci.coveredByOwner(pod([]metav1.OwnerReference{{Kind: "Rollout", Name: "canary", Controller: ptr.To(true)}}, "app:v1")), "owner is not watched")
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	// metadataCacheTTL is how long metadata of a digest no image resolves to anymore is kept.
+	metadataCacheTTL = 24 * time.Hour
+	// metadataCachePruneSize is the number of cached digests above which stale entries are dropped.
+	metadataCachePruneSize = 10000
+)
+
+// metadataCache fetches metadata of image digests. A digest never changes its content, so metadata is fetched
+// once per digest. It is safe for concurrent use.
+type metadataCache struct {
+	lock    sync.Mutex
+	entries map[string]metadataCacheEntry
+	// annotations are the annotations every image reports, missing ones are empty.
+	annotations []string
+}
+
+type metadataCacheEntry struct {
+	metadata store.ImageMetadata
+	usedAt   time.Time
+}
+
+func newMetadataCache(annotations []string) *metadataCache {
+	return &metadataCache{
+		entries:     make(map[string]metadataCacheEntry),
+		annotations: annotations,
+	}
+}
+
+// get returns metadata of the digest. For an index, it describes the image for the first of the platforms
+// the index has, or its first image.
+func (c *metadataCache) get(digest name.Digest, platforms []v1.Platform, kc authn.Keychain, registryTransport http.RoundTripper) (store.ImageMetadata, error) {
+	key := digest.String()
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		entry.usedAt = time.Now()
+		c.entries[key] = entry
+	}
+	c.lock.Unlock()
+
+	if ok {
+		return entry.metadata, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	metadata, err := fetchMetadata(digest, platforms, c.annotations,
+		remote.WithAuthFromKeychain(keychainOrAnonymous(kc)),
+		remote.WithTransport(registryTransport),
+		remote.WithContext(ctx),
+	)
+	if err != nil {
+		return store.ImageMetadata{}, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= metadataCachePruneSize {
+		for k, e := range c.entries {
+			if time.Since(e.usedAt) >= metadataCacheTTL {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = metadataCacheEntry{metadata: metadata, usedAt: time.Now()}
+
+	return metadata, nil
+}
+
+// fetchMetadata fetches the manifest and the config of the image. Annotations are taken from the index,
+// the image manifest and the config labels, in that order of precedence.
+func fetchMetadata(digest name.Digest, platforms []v1.Platform, annotations []string, opts ...remote.Option) (store.ImageMetadata, error) {
+	desc, err := remote.Get(digest, opts...)
+	if err != nil {
+		return store.ImageMetadata{}, err
+	}
+
+	var indexAnnotations map[string]string
+	imageDigest := digest
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return store.ImageMetadata{}, err
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return store.ImageMetadata{}, err
+		}
+		indexAnnotations = indexManifest.Annotations
+
+		manifests := slices.DeleteFunc(slices.Clone(indexManifest.Manifests), func(m v1.Descriptor) bool {
+			return !relevantPlatform(m.Platform, nil)
+		})
+		if len(manifests) == 0 {
+			return store.ImageMetadata{}, errors.New("image index has no platform manifests")
+		}
+
+		manifest := manifests[0]
+		for _, platform := range platforms {
+			if i := slices.IndexFunc(manifests, func(m v1.Descriptor) bool { return platformSatisfies(*m.Platform, platform) }); i >= 0 {
+				manifest = manifests[i]
+				break
+			}
+		}
+		imageDigest = digest.Context().Digest(manifest.Digest.String())
+	}
+
+	img, err := remote.Image(imageDigest, opts...)
+	if err != nil {
+		return store.ImageMetadata{}, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return store.ImageMetadata{}, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return store.ImageMetadata{}, err
+	}
+
+	metadata := store.ImageMetadata{
+		Created:        configFile.Created.Time,
+		CompressedSize: manifest.Config.Size,
+		Layers:         len(manifest.Layers),
+		Annotations:    make(map[string]string, len(annotations)),
+	}
+	for _, layer := range manifest.Layers {
+		metadata.CompressedSize += layer.Size
+	}
+
+	for _, annotation := range annotations {
+		metadata.Annotations[annotation] = ""
+		for _, source := range []map[string]string{indexAnnotations, manifest.Annotations, configFile.Config.Labels} {
+			if value := source[annotation]; value != "" {
+				metadata.Annotations[annotation] = value
+				break
+			}
+		}
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_metadataCache_get(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	newImage := func(platform v1.Platform, labels map[string]string) v1.Image {
+		t.Helper()
+
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+		img, err = mutate.ConfigFile(img, &v1.ConfigFile{
+			OS:           platform.OS,
+			Architecture: platform.Architecture,
+			Created:      v1.Time{Time: created},
+			Config:       v1.Config{Labels: labels},
+		})
+		require.NoError(t, err)
+
+		return img
+	}
+
+	imageRef, err := parseImageName(host+"/test/image:latest", "", true)
+	require.NoError(t, err)
+	img := mutate.Annotations(
+		newImage(v1.Platform{OS: "linux", Architecture: "amd64"}, map[string]string{"org.opencontainers.image.source": "https://example.com/label"}),
+		map[string]string{"org.opencontainers.image.source": "https://example.com/annotation"},
+	).(v1.Image)
+	require.NoError(t, remote.Write(imageRef, img))
+
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	imageSize := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		imageSize += layer.Size
+	}
+
+	indexRef, err := parseImageName(host+"/test/index:latest", "", true)
+	require.NoError(t, err)
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	require.NoError(t, remote.WriteIndex(indexRef, mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: newImage(v1.Platform{OS: "linux", Architecture: "amd64"}, nil), Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: newImage(arm64, map[string]string{"org.opencontainers.image.revision": "abc123"}), Descriptor: v1.Descriptor{Platform: &arm64}},
+	)))
+
+	cache := newMetadataCache([]string{"org.opencontainers.image.source", "org.opencontainers.image.revision"})
+
+	get := func(ref string, platforms []v1.Platform) store.ImageMetadata {
+		t.Helper()
+
+		desc, err := remote.Head(mustParseReference(t, ref))
+		require.NoError(t, err)
+
+		metadata, err := cache.get(mustParseReference(t, ref).Context().Digest(desc.Digest.String()), platforms, nil, http.DefaultTransport)
+		require.NoError(t, err)
+
+		return metadata
+	}
+
+	assert.Equal(t, store.ImageMetadata{
+		Created:        created,
+		CompressedSize: imageSize,
+		Layers:         2,
+		Annotations: map[string]string{
+			"org.opencontainers.image.source":   "https://example.com/annotation",
+			"org.opencontainers.image.revision": "",
+		},
+	}, get(imageRef.String(), nil))
+	assert.Len(t, cache.entries, 1)
+
+	metadata := get(indexRef.String(), []v1.Platform{arm64})
+	assert.Equal(t, "abc123", metadata.Annotations["org.opencontainers.image.revision"], "the image of the node platform is described")
+	assert.Len(t, cache.entries, 2)
+}
+
+func mustParseReference(t *testing.T, image string) name.Reference {
+	t.Helper()
+
+	ref, err := parseImageName(image, "", true)
+	require.NoError(t, err)
+
+	return ref
+}
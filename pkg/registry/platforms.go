@@ -0,0 +1,277 @@
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const windowsBuildLabel = "node.kubernetes.io/windows-build"
+
+// nodePlacement holds the constraints of the pod template that select the nodes its pods may run on.
+type nodePlacement struct {
+	nodeName     string
+	nodeSelector map[string]string
+	// nodeAffinity is the required node affinity, the preferred one does not restrict the nodes.
+	nodeAffinity *corev1.NodeSelector
+}
+
+func placementFromPodSpec(podSpec *corev1.PodSpec) nodePlacement {
+	placement := nodePlacement{
+		nodeName:     podSpec.NodeName,
+		nodeSelector: podSpec.NodeSelector,
+	}
+
+	if podSpec.Affinity != nil && podSpec.Affinity.NodeAffinity != nil {
+		placement.nodeAffinity = podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	}
+
+	return placement
+}
+
+// matches reports whether pods with the placement may run on the node.
+func (p nodePlacement) matches(node *corev1.Node) bool {
+	if p.nodeName != "" {
+		return p.nodeName == node.Name
+	}
+
+	if !labels.SelectorFromSet(p.nodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+
+	if p.nodeAffinity == nil || len(p.nodeAffinity.NodeSelectorTerms) == 0 {
+		return true
+	}
+
+	// Terms are ORed, requirements of a term are ANDed.
+	for _, term := range p.nodeAffinity.NodeSelectorTerms {
+		if nodeSelectorTermMatches(term, node) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nodeSelectorTermMatches(term corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+
+	for _, req := range term.MatchExpressions {
+		if !nodeSelectorRequirementMatches(req, labels.Set(node.Labels)) {
+			return false
+		}
+	}
+
+	// metadata.name is the only supported field.
+	for _, req := range term.MatchFields {
+		if req.Key != "metadata.name" || !nodeSelectorRequirementMatches(req, labels.Set{req.Key: node.Name}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+func nodeSelectorRequirementMatches(req corev1.NodeSelectorRequirement, nodeLabels labels.Set) bool {
+	op, ok := nodeSelectorOperators[req.Operator]
+	if !ok {
+		return false
+	}
+
+	requirement, err := labels.NewRequirement(req.Key, op, req.Values)
+	if err != nil {
+		logrus.Debug(err)
+		return false
+	}
+
+	return requirement.Matches(nodeLabels)
+}
+
+// trimNode is the transform function of the node informer, it drops everything but the name and the labels,
+// which node selectors match against, and the platform of the node, e.g., the images of the status.
+func trimNode(obj interface{}) (interface{}, error) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return obj, nil
+	}
+
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            node.Name,
+			UID:             node.UID,
+			ResourceVersion: node.ResourceVersion,
+			Labels:          node.Labels,
+		},
+		Status: corev1.NodeStatus{
+			NodeInfo: corev1.NodeSystemInfo{
+				OperatingSystem: node.Status.NodeInfo.OperatingSystem,
+				Architecture:    node.Status.NodeInfo.Architecture,
+			},
+		},
+	}, nil
+}
+
+// nodePlatform returns the platform of the node, the OS version is only set for Windows nodes.
+func nodePlatform(node *corev1.Node) v1.Platform {
+	platform := v1.Platform{
+		OS:           node.Labels[corev1.LabelOSStable],
+		Architecture: node.Labels[corev1.LabelArchStable],
+	}
+
+	if platform.OS == "" {
+		platform.OS = node.Status.NodeInfo.OperatingSystem
+	}
+	if platform.Architecture == "" {
+		platform.Architecture = node.Status.NodeInfo.Architecture
+	}
+	if platform.OS == "windows" {
+		platform.OSVersion = node.Labels[windowsBuildLabel]
+	}
+
+	return platform
+}
+
+// GetPlatformsForImage returns platforms of the nodes that workloads using the image may run on. Images used
+// as image volumes only are not executed, so they may be built for any platform.
+func (ci ControllerIndexers) GetPlatformsForImage(image string) (ret []v1.Platform) {
+	if ci.nodeIndexer == nil {
+		return nil
+	}
+
+	var placements []nodePlacement
+	for _, indexer := range ci.controllerIndexers() {
+		objs, err := indexer.ByIndex(imageIndexName, image)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+
+		for _, obj := range objs {
+			cis := obj.(*controllerWithContainerInfos)
+			if !ci.validCi(cis) || !cis.runsImage(image) {
+				continue
+			}
+
+			placements = append(placements, cis.placement)
+		}
+	}
+
+	if len(placements) == 0 {
+		return nil
+	}
+
+	for _, obj := range ci.nodeIndexer.List() {
+		node := obj.(*corev1.Node)
+
+		if !slices.ContainsFunc(placements, func(p nodePlacement) bool { return p.matches(node) }) {
+			continue
+		}
+
+		platform := nodePlatform(node)
+		if platform.OS == "" || platform.Architecture == "" {
+			continue
+		}
+		if !slices.ContainsFunc(ret, platform.Equals) {
+			ret = append(ret, platform)
+		}
+	}
+
+	return ret
+}
+
+// missingPlatforms returns the required platforms the image has no manifest for. The platforms of an index are
+// taken from its manifest list, the platform of a single image is taken from its config. Artifacts without
+// a platform, e.g., OCI artifacts mounted as image volumes, are platform-agnostic and miss nothing.
+func missingPlatforms(ref name.Reference, desc *v1.Descriptor, required []v1.Platform, opts ...remote.Option) ([]string, error) {
+	digest := ref.Context().Digest(desc.Digest.String())
+
+	var available []v1.Platform
+	if desc.MediaType.IsIndex() {
+		index, err := remote.Index(digest, opts...)
+		if err != nil {
+			return nil, err
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, manifest := range indexManifest.Manifests {
+			if manifest.Platform != nil {
+				available = append(available, *manifest.Platform)
+			}
+		}
+	} else {
+		img, err := remote.Image(digest, opts...)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.Config.MediaType.IsConfig() {
+			return nil, nil
+		}
+		configFile, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+
+		if platform := configFile.Platform(); platform != nil && platform.OS != "" && platform.Architecture != "" {
+			available = append(available, *platform)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil, nil
+	}
+
+	var missing []string
+	for _, platform := range required {
+		if !slices.ContainsFunc(available, func(a v1.Platform) bool { return platformSatisfies(a, platform) }) {
+			missing = append(missing, platform.String())
+		}
+	}
+	slices.Sort(missing)
+
+	return missing, nil
+}
+
+// platformSatisfies reports whether an image built for the platform runs on the node platform. Windows images
+// have to match the build of the node, e.g., the "10.0.17763.5576" image version runs on the "10.0.17763" build.
+func platformSatisfies(image, node v1.Platform) bool {
+	if image.OS != node.OS || image.Architecture != node.Architecture {
+		return false
+	}
+
+	if node.OSVersion == "" || image.OSVersion == "" {
+		return true
+	}
+
+	return image.OSVersion == node.OSVersion || strings.HasPrefix(image.OSVersion, node.OSVersion+".")
+}
+
+func platformMismatchError(missing []string) error {
+	return fmt.Errorf("image has no manifests for the platforms of the nodes: %s", strings.Join(missing, ", "))
+}
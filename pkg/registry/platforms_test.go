@@ -0,0 +1,242 @@
+package registry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_nodePlacement_matches(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node-1",
+			Labels: map[string]string{
+				corev1.LabelOSStable:   "linux",
+				corev1.LabelArchStable: "arm64",
+				"pool":                 "batch",
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		placement nodePlacement
+		matches   bool
+	}{
+		{name: "no constraints", matches: true},
+		{name: "node name", placement: nodePlacement{nodeName: "node-2"}, matches: false},
+		{name: "node selector", placement: nodePlacement{nodeSelector: map[string]string{corev1.LabelArchStable: "arm64"}}, matches: true},
+		{name: "node selector mismatch", placement: nodePlacement{nodeSelector: map[string]string{corev1.LabelArchStable: "amd64"}}, matches: false},
+		{
+			name: "affinity terms are ORed",
+			placement: nodePlacement{nodeAffinity: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"web"}}}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "pool", Operator: corev1.NodeSelectorOpExists}}},
+			}}},
+			matches: true,
+		},
+		{
+			name: "affinity requirements are ANDed",
+			placement: nodePlacement{nodeAffinity: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"batch"}},
+					{Key: corev1.LabelArchStable, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"arm64"}},
+				}},
+			}}},
+			matches: false,
+		},
+		{
+			name: "affinity by node name",
+			placement: nodePlacement{nodeAffinity: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-1"}}}},
+			}}},
+			matches: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.matches, tc.placement.matches(node))
+		})
+	}
+}
+
+func Test_platformSatisfies(t *testing.T) {
+	linuxArm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	windows := v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763"}
+
+	assert.True(t, platformSatisfies(v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, linuxArm64))
+	assert.False(t, platformSatisfies(v1.Platform{OS: "linux", Architecture: "amd64"}, linuxArm64))
+	assert.True(t, platformSatisfies(v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5576"}, windows))
+	assert.False(t, platformSatisfies(v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2340"}, windows))
+	assert.False(t, platformSatisfies(v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.177630.1"}, windows))
+}
+
+func Test_checkPlatforms(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	indexRef, err := parseImageName(host+"/test/index:latest", "", true)
+	require.NoError(t, err)
+
+	var addenda []mutate.IndexAddendum
+	for _, platform := range []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}} {
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+	require.NoError(t, remote.WriteIndex(indexRef, mutate.AppendManifests(empty.Index, addenda...)))
+
+	imageRef, err := parseImageName(host+"/test/image:latest", "", true)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	img, err = mutate.ConfigFile(img, &v1.ConfigFile{OS: "linux", Architecture: "amd64"})
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(imageRef, img))
+
+	artifactRef, err := parseImageName(host+"/test/artifact:latest", "", true)
+	require.NoError(t, err)
+
+	artifact, err := mutate.ConfigFile(img, &v1.ConfigFile{})
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(artifactRef, artifact))
+
+	helmChartRef, err := parseImageName(host+"/test/chart:latest", "", true)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(helmChartRef, mutate.ConfigMediaType(empty.Image, "application/vnd.cncf.helm.config.v1+json")))
+
+	for _, tc := range []struct {
+		name      string
+		ref       string
+		platforms []v1.Platform
+		availMode store.AvailabilityMode
+		reason    string
+	}{
+		{
+			name:      "index covers the platforms",
+			ref:       indexRef.String(),
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			availMode: store.Available,
+		},
+		{
+			name:      "index misses platforms",
+			ref:       indexRef.String(),
+			platforms: []v1.Platform{{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763"}, {OS: "linux", Architecture: "s390x"}},
+			availMode: store.PlatformMismatch,
+			reason:    "linux/s390x,windows/amd64:10.0.17763",
+		},
+		{
+			name:      "single image misses a platform",
+			ref:       imageRef.String(),
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			availMode: store.PlatformMismatch,
+			reason:    "linux/arm64",
+		},
+		{
+			name:      "config without a platform",
+			ref:       artifactRef.String(),
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+			availMode: store.Available,
+		},
+		{
+			name:      "artifact without an image config",
+			ref:       helmChartRef.String(),
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+			availMode: store.Available,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := parseImageName(tc.ref, "", true)
+			require.NoError(t, err)
+
+			result, _ := check(ref, nil, http.DefaultTransport, checkOptions{platforms: tc.platforms})
+			require.Equal(t, tc.availMode, result.AvailMode)
+			require.Equal(t, tc.reason, result.Reason)
+		})
+	}
+}
+
+func Test_GetPlatformsForImage_volumes(t *testing.T) {
+	newIndexer := func(indexers cache.Indexers, objs ...interface{}) cache.Indexer {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+		for _, obj := range objs {
+			require.NoError(t, indexer.Add(obj))
+		}
+		return indexer
+	}
+
+	ci := ControllerIndexers{
+		namespaceIndexer: newIndexer(namespaceIndexers(""), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}),
+		nodeIndexer: newIndexer(cache.Indexers{}, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: map[string]string{corev1.LabelOSStable: "linux", corev1.LabelArchStable: "amd64"}},
+		}),
+		deploymentIndexer: newIndexer(imageIndexers, &controllerWithContainerInfos{
+			ObjectMeta:        metav1.ObjectMeta{Namespace: "test", Name: "app"},
+			controllerKind:    "Deployment",
+			containerToImages: map[string]containerImage{"app": {image: "registry.test/app:v1", containerType: store.ContainerTypeRegular}},
+			volumeToImages:    map[string]string{"models": "registry.test/models:v1"},
+			enabled:           true,
+		}),
+		statefulSetIndexer:           newIndexer(imageIndexers),
+		daemonSetIndexer:             newIndexer(imageIndexers),
+		cronJobIndexer:               newIndexer(imageIndexers),
+		jobIndexer:                   newIndexer(imageIndexers),
+		replicaSetIndexer:            newIndexer(imageIndexers),
+		replicationControllerIndexer: newIndexer(imageIndexers),
+		podIndexer:                   newIndexer(imageIndexers),
+	}
+
+	assert.Equal(t, []v1.Platform{{OS: "linux", Architecture: "amd64"}}, ci.GetPlatformsForImage("registry.test/app:v1"))
+	assert.Empty(t, ci.GetPlatformsForImage("registry.test/models:v1"), "image volumes are not executed")
+}
+
+func Test_trimNode(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node",
+			Labels:      map[string]string{corev1.LabelOSStable: "linux", "node-role.kubernetes.io/worker": ""},
+			Annotations: map[string]string{"node.alpha.kubernetes.io/ttl": "0"},
+		},
+		Spec: corev1.NodeSpec{PodCIDR: "10.0.0.0/24"},
+		Status: corev1.NodeStatus{
+			NodeInfo: corev1.NodeSystemInfo{OperatingSystem: "linux", Architecture: "arm64", KernelVersion: "6.1.0"},
+			Images:   []corev1.ContainerImage{{Names: []string{"registry.test/app:v1"}}},
+		},
+	}
+
+	trimmed, err := trimNode(node)
+	require.NoError(t, err)
+	require.Equal(t, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: node.Labels},
+		Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{OperatingSystem: "linux", Architecture: "arm64"}},
+	}, trimmed)
+	require.Equal(t, v1.Platform{OS: "linux", Architecture: "arm64"}, nodePlatform(trimmed.(*corev1.Node)))
+
+	tombstone := cache.DeletedFinalStateUnknown{Key: "node", Obj: node}
+	trimmed, err = trimNode(tombstone)
+	require.NoError(t, err)
+	require.Equal(t, tombstone, trimmed)
+}
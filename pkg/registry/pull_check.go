@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// containerdManifestAccept is the Accept header containerd sends when it resolves an image for a pull.
+const containerdManifestAccept = "application/vnd.docker.distribution.manifest.v2+json, " +
+	"application/vnd.docker.distribution.manifest.list.v2+json, " +
+	"application/vnd.oci.image.manifest.v1+json, " +
+	"application/vnd.oci.image.index.v1+json, */*"
+
+// pullManifest fetches the manifest the way containerd does. Registries like Harbor enforce pull policies,
+// e.g., vulnerability or signature gates, on the manifest GET only, while HEAD requests still succeed.
+func pullManifest(ctx context.Context, ref name.Reference, kc authn.Keychain, registryTransport http.RoundTripper) error {
+	auth, err := authn.Resolve(ctx, kc, ref.Context())
+	if err != nil {
+		return err
+	}
+
+	rt, err := transport.NewWithContext(ctx, ref.Context().Registry, auth, registryTransport, []string{ref.Scope(transport.PullScope)})
+	if err != nil {
+		return err
+	}
+
+	u := url.URL{
+		Scheme: ref.Context().Scheme(),
+		Host:   ref.Context().RegistryStr(),
+		Path:   "/v2/" + ref.Context().RepositoryStr() + "/manifests/" + ref.Identifier(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", containerdManifestAccept)
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return &pullError{err: err}
+	}
+
+	return nil
+}
+
+// pullError marks errors of the manifest GET, so that other requests denied with 403 are not taken for blocked pulls.
+type pullError struct {
+	err error
+}
+
+func (e *pullError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pullError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkPulls(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+
+	// Emulate Harbor that blocks pulls of the "blocked" repository by a vulnerability policy.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blocked/manifests/") {
+			assert.Equal(t, containerdManifestAccept, r.Header.Get("Accept"))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = io.WriteString(w, `{"errors":[{"code":"PRECONDITION","message":"current image with 2 vulnerabilities cannot be pulled due to configured policy"}]}`)
+			return
+		}
+
+		registryHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, image := range []string{"test/allowed:latest", "test/blocked:latest"} {
+		ref, err := parseImageName(host+"/"+image, "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+	}
+
+	for _, tc := range []struct {
+		image     string
+		pull      bool
+		availMode store.AvailabilityMode
+		reason    string
+	}{
+		{image: "test/allowed:latest", pull: true, availMode: store.Available},
+		{image: "test/blocked:latest", pull: false, availMode: store.Available},
+		{
+			image:     "test/blocked:latest",
+			pull:      true,
+			availMode: store.PullBlocked,
+			reason:    ReasonPolicy,
+		},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			ref, err := parseImageName(host+"/"+tc.image, "", true)
+			require.NoError(t, err)
+
+			result, err := check(ref, nil, http.DefaultTransport, checkOptions{pull: tc.pull})
+			require.Equal(t, tc.availMode, result.AvailMode)
+			require.Equal(t, tc.reason, result.Reason)
+			if tc.availMode == store.PullBlocked {
+				require.ErrorContains(t, err, "cannot be pulled due to configured policy")
+			}
+		})
+	}
+}
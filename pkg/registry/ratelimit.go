@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryAfterTransport remembers the Retry-After header of the last 429 response of each registry host,
+// because transport errors returned by go-containerregistry do not carry response headers.
+type retryAfterTransport struct {
+	inner http.RoundTripper
+
+	lock       sync.Mutex
+	retryAfter map[string]time.Duration
+}
+
+func newRetryAfterTransport(inner http.RoundTripper) *retryAfterTransport {
+	return &retryAfterTransport{
+		inner:      inner,
+		retryAfter: make(map[string]time.Duration),
+	}
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); retryAfter > 0 {
+		t.lock.Lock()
+		t.retryAfter[req.URL.Host] = retryAfter
+		t.lock.Unlock()
+	}
+
+	return resp, err
+}
+
+// RetryAfter returns and forgets the delay requested by the last 429 response of the registry host.
+func (t *retryAfterTransport) RetryAfter(host string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	retryAfter := t.retryAfter[host]
+	delete(t.retryAfter, host)
+
+	return retryAfter
+}
+
+// parseRetryAfter parses the Retry-After header value, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+
+	return 0
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flant/k8s-image-availability-exporter/pkg/store"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "120", expected: 2 * time.Minute},
+		{value: "0", expected: 0},
+		{value: now.Add(90 * time.Second).Format(http.TimeFormat), expected: 90 * time.Second},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), expected: -time.Minute},
+		{value: "", expected: 0},
+		{value: "soon", expected: 0},
+		{value: "1.5", expected: 0},
+	} {
+		require.Equal(t, tc.expected, parseRetryAfter(tc.value, now), tc.value)
+	}
+}
+
+func Test_retryAfterTransport(t *testing.T) {
+	registryHandler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+
+	var (
+		throttled atomic.Bool
+		requests  atomic.Int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if throttled.Load() {
+			requests.Add(1)
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		registryHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var images []string
+	for _, image := range []string{"test/first:latest", "test/second:latest"} {
+		ref, err := parseImageName(host+"/"+image, "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+
+		images = append(images, ref.String())
+	}
+
+	transport := newRetryAfterTransport(http.DefaultTransport)
+	rc := &Checker{
+		registryTransport: transport,
+		retryAfter:        transport,
+		config:            registryCheckerConfig{plainHTTP: true},
+	}
+
+	var checks, rateLimitedChecks atomic.Int32
+	imageStore := store.NewImageStore(func(key store.ImageKey) store.CheckResult {
+		result := rc.checkImageAvailability(logrus.WithField("image_name", key.Image), key.Image, nil, checkOptions{})
+		checks.Add(1)
+		if result.AvailMode == store.RateLimited {
+			rateLimitedChecks.Add(1)
+		}
+		return result
+	}, rc.RegistryHost, 1, 0, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	imageStore.Run(stopCh)
+
+	for _, image := range images {
+		imageStore.ReconcileImage(store.ImageKey{Image: image}, []store.ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: image, Container: "test"}})
+	}
+	require.Eventually(t, func() bool { return checks.Load() >= 2 }, 10*time.Second, 10*time.Millisecond)
+
+	// The first rate limited check puts the registry into the requested cooldown, no other image of the registry
+	// is checked until it is over.
+	throttled.Store(true)
+	require.Eventually(t, func() bool { return rateLimitedChecks.Load() == 1 }, 30*time.Second, 10*time.Millisecond)
+	throttledChecks := checks.Load()
+	require.Never(t, func() bool { return checks.Load() > throttledChecks }, 500*time.Millisecond, 10*time.Millisecond)
+	require.Zero(t, transport.RetryAfter(host), "the delay is taken by the check")
+
+	// Both images keep their last known state.
+	available := 0
+	for _, m := range imageStore.ExtractMetrics() {
+		if !strings.Contains(m.Desc().String(), `"k8s_image_availability_exporter_available"`) {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+		require.Equal(t, 1.0, metric.Gauge.GetValue())
+		available++
+	}
+	require.Equal(t, 2, available)
+}
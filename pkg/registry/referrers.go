@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// artifactTypeAlternativesSeparator separates artifact types that satisfy the same requirement,
+// e.g., "application/spdx+json|application/vnd.cyclonedx+json" for an SBOM in either format.
+const artifactTypeAlternativesSeparator = "|"
+
+// referrerArtifacts reports for each required artifact type whether a referrer of the image has it. A referrer has
+// the artifact type if it is its OCI artifact type, or the predicate type of the attestation in a Sigstore bundle.
+// Registries without the referrers API are queried with the "sha256-<hex>" tag schema.
+func referrerArtifacts(digest name.Digest, required []string, kc authn.Keychain, registryTransport http.RoundTripper) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	index, err := remote.Referrers(digest,
+		remote.WithAuthFromKeychain(keychainOrAnonymous(kc)),
+		remote.WithTransport(registryTransport),
+		remote.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]bool, len(required))
+	for _, requirement := range required {
+		artifactTypes := strings.Split(requirement, artifactTypeAlternativesSeparator)
+
+		ret[requirement] = slices.ContainsFunc(indexManifest.Manifests, func(desc v1.Descriptor) bool {
+			return slices.Contains(artifactTypes, desc.ArtifactType) ||
+				(strings.HasPrefix(desc.ArtifactType, sigstoreBundleArtifactTypePrefix) && slices.Contains(artifactTypes, desc.Annotations[sigstoreBundlePredicateTypeKey]))
+		})
+	}
+
+	return ret, nil
+}
+
+func missingArtifactTypes(artifacts map[string]bool) (ret []string) {
+	for requirement, present := range artifacts {
+		if !present {
+			ret = append(ret, requirement)
+		}
+	}
+	slices.Sort(ret)
+
+	return ret
+}
@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSBOMRequirement       = "application/spdx+json|application/vnd.cyclonedx+json"
+	testProvenanceRequirement = "https://slsa.dev/provenance/v1"
+)
+
+// rawIndex is a referrers index written under the fallback tag by hand, as clients do for registries
+// without the referrers API.
+type rawIndex struct {
+	manifest v1.IndexManifest
+}
+
+func (i rawIndex) RawManifest() ([]byte, error)        { return json.Marshal(i.manifest) }
+func (i rawIndex) MediaType() (types.MediaType, error) { return types.OCIImageIndex, nil }
+
+func Test_referrerArtifacts(t *testing.T) {
+	required := []string{testSBOMRequirement, testProvenanceRequirement}
+
+	pushImage := func(t *testing.T, host string) name.Digest {
+		t.Helper()
+
+		ref, err := parseImageName(host+"/test/image:latest", "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+
+		desc, err := remote.Head(ref)
+		require.NoError(t, err)
+
+		return ref.Context().Digest(desc.Digest.String())
+	}
+
+	t.Run("referrers API", func(t *testing.T) {
+		server := httptest.NewServer(ggcrregistry.New(
+			ggcrregistry.Logger(log.New(io.Discard, "", 0)),
+			ggcrregistry.WithReferrersSupport(true),
+		))
+		defer server.Close()
+
+		digest := pushImage(t, strings.TrimPrefix(server.URL, "http://"))
+
+		subject, err := remote.Head(digest)
+		require.NoError(t, err)
+		sbom := mutate.Subject(
+			mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), "application/vnd.cyclonedx+json"),
+			*subject,
+		).(v1.Image)
+		sbomDigest, err := sbom.Digest()
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(digest.Context().Digest(sbomDigest.String()), sbom))
+
+		artifacts, err := referrerArtifacts(digest, required, nil, http.DefaultTransport)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]bool{testSBOMRequirement: true, testProvenanceRequirement: false}, artifacts)
+		assert.Equal(t, []string{testProvenanceRequirement}, missingArtifactTypes(artifacts))
+	})
+
+	t.Run("tag schema fallback", func(t *testing.T) {
+		server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+		defer server.Close()
+
+		digest := pushImage(t, strings.TrimPrefix(server.URL, "http://"))
+
+		hash, err := v1.NewHash(digest.DigestStr())
+		require.NoError(t, err)
+		require.NoError(t, remote.Put(digest.Context().Tag(hash.Algorithm+"-"+hash.Hex), rawIndex{v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIImageIndex,
+			Manifests: []v1.Descriptor{{
+				MediaType:    types.OCIManifestSchema1,
+				Digest:       hash,
+				Size:         1,
+				ArtifactType: "application/vnd.dev.sigstore.bundle.v0.3+json",
+				Annotations:  map[string]string{sigstoreBundlePredicateTypeKey: testProvenanceRequirement},
+			}},
+		}}))
+
+		artifacts, err := referrerArtifacts(digest, required, nil, http.DefaultTransport)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]bool{testSBOMRequirement: false, testProvenanceRequirement: true}, artifacts)
+	})
+}
@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ownerIndexName = "owner"
+
+	deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+)
+
+var (
+	ownerIndexers = cache.Indexers{
+		ownerIndexName: func(obj interface{}) ([]string, error) {
+			ownerRef := metav1.GetControllerOfNoCopy(&obj.(*controllerWithContainerInfos).ObjectMeta)
+			if ownerRef == nil {
+				return nil, nil
+			}
+
+			return []string{string(ownerRef.UID)}, nil
+		},
+	}
+)
+
+func getImagesFromControllerRevision(obj interface{}) (interface{}, error) {
+	if cis, ok := obj.(*controllerWithContainerInfos); ok {
+		return cis, nil
+	}
+
+	controllerRevision := obj.(*appsv1.ControllerRevision)
+
+	controllerRevisionCopy := controllerRevision.DeepCopy()
+
+	// StatefulSet and DaemonSet revisions store the pod template as a strategic merge patch
+	// of the form {"spec":{"template":{...,"$patch":"replace"}}}.
+	var patch struct {
+		Spec struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if len(controllerRevisionCopy.Data.Raw) > 0 {
+		if err := json.Unmarshal(controllerRevisionCopy.Data.Raw, &patch); err != nil {
+			logrus.Warnf("Failed to parse ControllerRevision %s/%s: %v", controllerRevisionCopy.Namespace, controllerRevisionCopy.Name, err)
+		}
+	}
+	podSpec := patch.Spec.Template.Spec
+
+	return &controllerWithContainerInfos{
+		ObjectMeta:           controllerRevisionCopy.ObjectMeta,
+		controllerKind:       "ControllerRevision",
+		containerToImages:    extractImagesFromPodSpec(&podSpec),
+		volumeToImages:       extractImagesFromVolumes(podSpec.Volumes),
+		pullSecretReferences: podSpec.ImagePullSecrets,
+		placement:            placementFromPodSpec(&podSpec),
+		serviceAccountName:   podSpec.ServiceAccountName,
+		revision:             controllerRevisionCopy.Revision,
+		// Revisions never run pods by themselves, they are only reported as rollback targets.
+		enabled: false,
+	}, nil
+}
+
+func replicaSetRevision(replicaSet *appsv1.ReplicaSet) int64 {
+	revision, err := strconv.ParseInt(replicaSet.Annotations[deploymentRevisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return revision
+}
+
+// rollbackRevision reports whether the object is one of the previous revisions of a Deployment, StatefulSet or
+// DaemonSet that the controller can be rolled back to.
+func (ci ControllerIndexers) rollbackRevision(cis *controllerWithContainerInfos) (int64, bool) {
+	if ci.rollbackRevisions <= 0 || cis.revision == 0 {
+		return 0, false
+	}
+
+	ownerRef := metav1.GetControllerOfNoCopy(&cis.ObjectMeta)
+	if ownerRef == nil {
+		return 0, false
+	}
+
+	var indexer cache.Indexer
+	switch {
+	case cis.controllerKind == "ReplicaSet" && ownerRef.Kind == "Deployment":
+		indexer = ci.replicaSetIndexer
+	case cis.controllerKind == "ControllerRevision" && (ownerRef.Kind == "StatefulSet" || ownerRef.Kind == "DaemonSet"):
+		indexer = ci.controllerRevisionIndexer
+	default:
+		return 0, false
+	}
+
+	siblings, err := indexer.ByIndex(ownerIndexName, string(ownerRef.UID))
+	if err != nil {
+		logrus.Warn(err)
+		return 0, false
+	}
+
+	revisions := make([]int64, 0, len(siblings))
+	for _, sibling := range siblings {
+		if revision := sibling.(*controllerWithContainerInfos).revision; revision > 0 {
+			revisions = append(revisions, revision)
+		}
+	}
+	slices.Sort(revisions)
+	revisions = slices.Compact(revisions)
+	slices.Reverse(revisions)
+
+	// The newest revision is the current one.
+	if len(revisions) < 2 {
+		return 0, false
+	}
+	previous := revisions[1:min(len(revisions), ci.rollbackRevisions+1)]
+
+	return cis.revision, slices.Contains(previous, cis.revision)
+}
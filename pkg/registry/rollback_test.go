@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+)
+
+func Test_rollbackRevision(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, ownerIndexers)
+
+	replicaSets := make([]*controllerWithContainerInfos, 0, 4)
+	for revision := int64(1); revision <= 4; revision++ {
+		replicaSet := &controllerWithContainerInfos{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns",
+				Name:      fmt.Sprintf("app-%d", revision),
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "Deployment", Name: "app", UID: types.UID("deployment-uid"), Controller: ptr.To(true)},
+				},
+			},
+			controllerKind: "ReplicaSet",
+			revision:       revision,
+		}
+		require.NoError(t, indexer.Add(replicaSet))
+		replicaSets = append(replicaSets, replicaSet)
+	}
+
+	ci := ControllerIndexers{replicaSetIndexer: indexer, rollbackRevisions: 2}
+
+	for _, tc := range []struct {
+		revision int64
+		rollback bool
+	}{
+		{revision: 1, rollback: false},
+		{revision: 2, rollback: true},
+		{revision: 3, rollback: true},
+		{revision: 4, rollback: false},
+	} {
+		revision, rollback := ci.rollbackRevision(replicaSets[tc.revision-1])
+		require.Equal(t, tc.rollback, rollback, "revision %d", tc.revision)
+		if rollback {
+			require.Equal(t, tc.revision, revision)
+		}
+	}
+
+	ci.rollbackRevisions = 0
+	_, rollback := ci.rollbackRevision(replicaSets[2])
+	require.False(t, rollback)
+}
+
+func Test_getImagesFromControllerRevision(t *testing.T) {
+	controllerRevision := &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "db-7c9f6"},
+		Data: runtime.RawExtension{
+			Raw: []byte(`{"spec":{"template":{"$patch":"replace","spec":{"containers":[{"name":"db","image":"postgres:15"}]}}}}`),
+		},
+		Revision: 3,
+	}
+
+	obj, err := getImagesFromControllerRevision(controllerRevision)
+	require.NoError(t, err)
+
+	cis := obj.(*controllerWithContainerInfos)
+	require.Equal(t, int64(3), cis.revision)
+	require.False(t, cis.enabled)
+	require.Equal(t, []string{"postgres:15"}, cis.images())
+}
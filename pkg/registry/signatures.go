@@ -0,0 +1,333 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// cosignSignatureMediaType is the media type of layers of cosign signature manifests, their blobs hold
+	// the signed payload and the signature is kept in the layer annotation.
+	cosignSignatureMediaType  types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation                 = "dev.cosignproject.cosign/signature"
+	// cosignSignatureArtifactType is the artifact type of signatures attached with the OCI referrers API.
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	// Sigstore bundles are used for both signatures and attestations, signatures are told apart by the predicate type.
+	sigstoreBundleArtifactTypePrefix = "application/vnd.dev.sigstore.bundle"
+	sigstoreBundlePredicateTypeKey   = "dev.sigstore.bundle.predicateType"
+	cosignSignPredicateType          = "https://sigstore.dev/cosign/sign/v1"
+
+	// maxSignatureBlobSize limits blobs read for verification, signature payloads are tiny.
+	maxSignatureBlobSize = 1 << 20
+)
+
+// signatureVerifier looks up cosign signatures of images. Without keys any signature counts, otherwise a signature
+// has to be verified by one of the keys.
+type signatureVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// loadSignaturePublicKeys reads PEM encoded public keys, a file may contain several keys.
+func loadSignaturePublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		rest, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing public key in %q: %w", path, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(paths) > 0 && len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM encoded public keys found in %s", strings.Join(paths, ", "))
+	}
+
+	return keys, nil
+}
+
+// signed reports whether the image has a signature, either under the "sha256-<hex>.sig" tag or among
+// the artifacts referring to the image.
+func (v *signatureVerifier) signed(digest name.Digest, kc authn.Keychain, registryTransport http.RoundTripper) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	opts := []remote.Option{
+		remote.WithAuthFromKeychain(keychainOrAnonymous(kc)),
+		remote.WithTransport(registryTransport),
+		remote.WithContext(ctx),
+	}
+
+	hash, err := v1.NewHash(digest.DigestStr())
+	if err != nil {
+		return false, err
+	}
+
+	signed, err := v.signedByTag(digest.Context().Tag(hash.Algorithm+"-"+hash.Hex+".sig"), hash, opts...)
+	if err != nil || signed {
+		return signed, err
+	}
+
+	return v.signedByReferrers(digest, hash, opts...)
+}
+
+func (v *signatureVerifier) signedByTag(tag name.Tag, hash v1.Hash, opts ...remote.Option) (bool, error) {
+	img, err := remote.Image(tag, opts...)
+	if err != nil {
+		var transportErr *transport.Error
+		if errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return v.signedByManifest(img, hash)
+}
+
+func (v *signatureVerifier) signedByReferrers(digest name.Digest, hash v1.Hash, opts ...remote.Option) (bool, error) {
+	index, err := remote.Referrers(digest, opts...)
+	if err != nil {
+		return false, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return false, err
+	}
+
+	repo := digest.Context()
+	for _, desc := range indexManifest.Manifests {
+		var signed bool
+
+		switch {
+		case desc.ArtifactType == cosignSignatureArtifactType:
+			if len(v.keys) == 0 {
+				return true, nil
+			}
+
+			img, err := remote.Image(repo.Digest(desc.Digest.String()), opts...)
+			if err != nil {
+				return false, err
+			}
+			signed, err = v.signedByManifest(img, hash)
+			if err != nil {
+				return false, err
+			}
+		case strings.HasPrefix(desc.ArtifactType, sigstoreBundleArtifactTypePrefix) && desc.Annotations[sigstoreBundlePredicateTypeKey] == cosignSignPredicateType:
+			if len(v.keys) == 0 {
+				return true, nil
+			}
+
+			img, err := remote.Image(repo.Digest(desc.Digest.String()), opts...)
+			if err != nil {
+				return false, err
+			}
+			signed, err = v.signedByBundle(img, hash)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if signed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// signedByManifest checks the simple signing layers of a cosign signature manifest.
+func (v *signatureVerifier) signedByManifest(img v1.Image, hash v1.Hash) (bool, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignSignatureMediaType {
+			continue
+		}
+		if len(v.keys) == 0 {
+			return true, nil
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil {
+			continue
+		}
+		payload, err := readBlob(img, layer.Digest)
+		if err != nil {
+			return false, err
+		}
+
+		if v.verify(payload, signature) && simpleSigningPayloadMatches(payload, hash) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// signedByBundle checks the DSSE envelope of a sigstore bundle, the signed in-toto statement has to name the image.
+func (v *signatureVerifier) signedByBundle(img v1.Image, hash v1.Hash) (bool, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+
+	for _, layer := range manifest.Layers {
+		blob, err := readBlob(img, layer.Digest)
+		if err != nil {
+			return false, err
+		}
+
+		var bundle struct {
+			DSSEEnvelope *struct {
+				Payload     string `json:"payload"`
+				PayloadType string `json:"payloadType"`
+				Signatures  []struct {
+					Sig string `json:"sig"`
+				} `json:"signatures"`
+			} `json:"dsseEnvelope"`
+		}
+		if err := json.Unmarshal(blob, &bundle); err != nil || bundle.DSSEEnvelope == nil {
+			continue
+		}
+
+		payload, err := base64.StdEncoding.DecodeString(bundle.DSSEEnvelope.Payload)
+		if err != nil || !inTotoStatementMatches(payload, hash) {
+			continue
+		}
+
+		pae := dssePreAuthEncoding(bundle.DSSEEnvelope.PayloadType, payload)
+		for _, sig := range bundle.DSSEEnvelope.Signatures {
+			signature, err := base64.StdEncoding.DecodeString(sig.Sig)
+			if err == nil && v.verify(pae, signature) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// verify reports whether any of the keys verifies the signature of the message, the way cosign signs with
+// ECDSA, RSA PKCS#1 v1.5 and Ed25519 keys.
+func (v *signatureVerifier) verify(message, signature []byte) bool {
+	digest := sha256.Sum256(message)
+
+	for _, key := range v.keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest[:], signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, message, signature) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func readBlob(img v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := img.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(io.LimitReader(rc, maxSignatureBlobSize))
+}
+
+// simpleSigningPayloadMatches reports whether the signed payload names the image, so that a signature copied from
+// another image is not accepted.
+func simpleSigningPayloadMatches(payload []byte, hash v1.Hash) bool {
+	var simpleSigning struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil {
+		return false
+	}
+
+	return simpleSigning.Critical.Image.DockerManifestDigest == hash.String()
+}
+
+func inTotoStatementMatches(payload []byte, hash v1.Hash) bool {
+	var statement struct {
+		Subject []struct {
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return false
+	}
+
+	for _, subject := range statement.Subject {
+		if subject.Digest[hash.Algorithm] == hash.Hex {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dssePreAuthEncoding returns the message DSSE signatures are computed over.
+func dssePreAuthEncoding(payloadType string, payload []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buf.Write(payload)
+
+	return buf.Bytes()
+}
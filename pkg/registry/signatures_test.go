@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signatureTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	return key, path
+}
+
+func signatureTestSign(t *testing.T, key *ecdsa.PrivateKey, message []byte) string {
+	t.Helper()
+
+	digest := sha256.Sum256(message)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// signatureTestManifest returns a cosign signature manifest of the digest signed with the key.
+func signatureTestManifest(t *testing.T, key *ecdsa.PrivateKey, digest v1.Hash) v1.Image {
+	t.Helper()
+
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"test"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest))
+
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer:       static.NewLayer(payload, cosignSignatureMediaType),
+		Annotations: map[string]string{cosignSignatureAnnotation: signatureTestSign(t, key, payload)},
+	})
+	require.NoError(t, err)
+
+	return img
+}
+
+func Test_loadSignaturePublicKeys(t *testing.T) {
+	_, path := signatureTestKey(t)
+
+	keys, err := loadSignaturePublicKeys([]string{path})
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	noKeysPath := filepath.Join(t.TempDir(), "empty.pub")
+	require.NoError(t, os.WriteFile(noKeysPath, nil, 0o600))
+	_, err = loadSignaturePublicKeys([]string{noKeysPath})
+	assert.Error(t, err)
+}
+
+func Test_signatureVerifier_signed(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(
+		ggcrregistry.Logger(log.New(io.Discard, "", 0)),
+		ggcrregistry.WithReferrersSupport(true),
+	))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	push := func(image string) name.Digest {
+		t.Helper()
+
+		ref, err := parseImageName(host+"/"+image, "", true)
+		require.NoError(t, err)
+
+		img, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img))
+
+		digest, err := img.Digest()
+		require.NoError(t, err)
+
+		return ref.Context().Digest(digest.String())
+	}
+
+	signingKey, signingKeyPath := signatureTestKey(t)
+	_, otherKeyPath := signatureTestKey(t)
+
+	tagSigned := push("test/tag-signed:latest")
+	tagSignedHash, err := v1.NewHash(tagSigned.DigestStr())
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(
+		tagSigned.Context().Tag("sha256-"+tagSignedHash.Hex+".sig"),
+		signatureTestManifest(t, signingKey, tagSignedHash),
+	))
+
+	referrerSigned := push("test/referrer-signed:latest")
+	referrerSignedHash, err := v1.NewHash(referrerSigned.DigestStr())
+	require.NoError(t, err)
+	subject, err := remote.Head(referrerSigned)
+	require.NoError(t, err)
+	referrer := mutate.Subject(
+		mutate.ConfigMediaType(signatureTestManifest(t, signingKey, referrerSignedHash), cosignSignatureArtifactType),
+		*subject,
+	).(v1.Image)
+	referrerDigest, err := referrer.Digest()
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(referrerSigned.Context().Digest(referrerDigest.String()), referrer))
+
+	// The signature of another image is copied under the ".sig" tag of this one.
+	copied := push("test/copied:latest")
+	copiedHash, err := v1.NewHash(copied.DigestStr())
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(
+		copied.Context().Tag("sha256-"+copiedHash.Hex+".sig"),
+		signatureTestManifest(t, signingKey, tagSignedHash),
+	))
+
+	unsigned := push("test/unsigned:latest")
+
+	for _, tc := range []struct {
+		name     string
+		digest   name.Digest
+		keyPaths []string
+		signed   bool
+	}{
+		{name: "tag signature", digest: tagSigned, signed: true},
+		{name: "verified tag signature", digest: tagSigned, keyPaths: []string{signingKeyPath}, signed: true},
+		{name: "tag signature by another key", digest: tagSigned, keyPaths: []string{otherKeyPath}, signed: false},
+		{name: "referrer signature", digest: referrerSigned, signed: true},
+		{name: "verified referrer signature", digest: referrerSigned, keyPaths: []string{otherKeyPath, signingKeyPath}, signed: true},
+		{name: "copied signature", digest: copied, signed: true},
+		{name: "verified copied signature", digest: copied, keyPaths: []string{signingKeyPath}, signed: false},
+		{name: "unsigned", digest: unsigned, signed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := loadSignaturePublicKeys(tc.keyPaths)
+			require.NoError(t, err)
+
+			signed, err := (&signatureVerifier{keys: keys}).signed(tc.digest, nil, http.DefaultTransport)
+			require.NoError(t, err)
+			assert.Equal(t, tc.signed, signed)
+		})
+	}
+}
+
+func Test_signatureVerifier_signedByBundle(t *testing.T) {
+	key, keyPath := signatureTestKey(t)
+	keys, err := loadSignaturePublicKeys([]string{keyPath})
+	require.NoError(t, err)
+
+	hash, err := v1.NewHash("sha256:" + strings.Repeat("a", 64))
+	require.NoError(t, err)
+
+	bundle := func(subject v1.Hash) v1.Image {
+		t.Helper()
+
+		const payloadType = "application/vnd.in-toto+json"
+		payload := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v1","subject":[{"name":"test","digest":{%q:%q}}],"predicateType":%q}`, subject.Algorithm, subject.Hex, cosignSignPredicateType))
+
+		blob, err := json.Marshal(map[string]any{
+			"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+			"dsseEnvelope": map[string]any{
+				"payload":     base64.StdEncoding.EncodeToString(payload),
+				"payloadType": payloadType,
+				"signatures":  []map[string]string{{"sig": signatureTestSign(t, key, dssePreAuthEncoding(payloadType, payload))}},
+			},
+		})
+		require.NoError(t, err)
+
+		img, err := mutate.AppendLayers(empty.Image, static.NewLayer(blob, "application/vnd.dev.sigstore.bundle.v0.3+json"))
+		require.NoError(t, err)
+
+		return img
+	}
+
+	signed, err := (&signatureVerifier{keys: keys}).signedByBundle(bundle(hash), hash)
+	require.NoError(t, err)
+	assert.True(t, signed)
+
+	otherHash, err := v1.NewHash("sha256:" + strings.Repeat("b", 64))
+	require.NoError(t, err)
+	signed, err = (&signatureVerifier{keys: keys}).signedByBundle(bundle(otherHash), hash)
+	require.NoError(t, err)
+	assert.False(t, signed, "statement of another image")
+}
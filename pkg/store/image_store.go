@@ -1,11 +1,11 @@
 package store
 
 import (
+	"maps"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gammazero/deque"
 	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
@@ -20,6 +20,14 @@ const (
 	AuthnFailure
 	AuthzFailure
 	UnknownError
+	RepositoryAbsent
+	ManifestAbsent
+	BadRepositoryName
+	BadTag
+	RateLimited
+	PlatformMismatch
+	BlobMissing
+	PullBlocked
 )
 
 var AvailabilityModeDescMap = map[AvailabilityMode]string{
@@ -30,176 +38,591 @@ var AvailabilityModeDescMap = map[AvailabilityMode]string{
 	AuthnFailure:        "authentication_failure",
 	AuthzFailure:        "authorization_failure",
 	UnknownError:        "unknown_error",
+	RepositoryAbsent:    "repository_absent",
+	ManifestAbsent:      "manifest_absent",
+	BadRepositoryName:   "bad_repository_name",
+	BadTag:              "bad_tag",
+	RateLimited:         "rate_limited",
+	PlatformMismatch:    "platform_mismatch",
+	BlobMissing:         "blob_missing",
+	PullBlocked:         "pull_blocked",
 }
 
 func (a AvailabilityMode) String() string {
 	return AvailabilityModeDescMap[a]
 }
 
+const (
+	ContainerTypeRegular   = "regular"
+	ContainerTypeInit      = "init"
+	ContainerTypeSidecar   = "sidecar"
+	ContainerTypeEphemeral = "ephemeral"
+)
+
 type ContainerInfo struct {
 	Namespace      string
 	ControllerKind string
 	ControllerName string
 	Container      string
+	ContainerType  string
+	// Volume is set instead of Container for OCI artifacts mounted as image volumes.
+	Volume string
+	// Revision is set for images of a previous controller revision that is kept for a rollback.
+	Revision string
+}
+
+// ImageMetadata describes the content an image reference resolves to, for an index it describes one of its images.
+type ImageMetadata struct {
+	Created time.Time
+	// CompressedSize is the total size of the config and layer blobs that are pulled.
+	CompressedSize int64
+	Layers         int
+	// Annotations holds the selected OCI annotations, every selected annotation is present even if the image lacks it.
+	Annotations map[string]string
+}
+
+// CheckResult is the outcome of a single image check.
+type CheckResult struct {
+	AvailMode AvailabilityMode
+	// Reason refines the availability mode, e.g., the kind of network failure for RegistryUnavailable.
+	Reason string
+	// RetryAfter is the cooldown requested by a registry that rate limited the check.
+	RetryAfter time.Duration
+	// Digest of the manifest the image reference resolved to, if the registry returned one.
+	Digest string
+	// PinnedTag is set for "repo:tag@digest" references, TagDigestMismatch tells that the tag points elsewhere.
+	PinnedTag         bool
+	TagDigestMismatch bool
+	// SignatureChecked is set if signatures of the image were looked up, Signed tells that one was found.
+	SignatureChecked bool
+	Signed           bool
+	// ReferrerArtifacts tells for each required artifact type whether a referrer of the image has it,
+	// it is nil if referrers were not looked up.
+	ReferrerArtifacts map[string]bool
+	// Metadata is nil if metadata was not fetched.
+	Metadata *ImageMetadata
+	// MissingBlobs holds the digests of the blobs the registry lost, see BlobMissing.
+	MissingBlobs []string
+	// StrictCredentials is set if the image was checked without the fallback to the default keychain,
+	// CredentialsMismatch tells that the image is available with the fallback only.
+	StrictCredentials   bool
+	CredentialsMismatch bool
+}
+
+// ImageKey identifies an image checked with a set of credentials. Workloads with different pull secrets may get
+// different results for the same image, so each credential set is checked separately.
+type ImageKey struct {
+	Image string
+	// Credentials is the sorted comma-separated list of "namespace/name" pull secrets, empty if there are none.
+	Credentials string
 }
 
 type ImageInfo struct {
 	ContainerInfo map[ContainerInfo]struct{}
 	AvailMode     AvailabilityMode
+	Reason        string
+	LastCheck     time.Time
+	Registry      string
+	// Digest is the last known digest the image reference resolved to.
+	Digest string
+	// DigestChanges counts how many times the digest changed since the image was first checked.
+	DigestChanges    int
+	LastDigestChange time.Time
+
+	PinnedTag         bool
+	TagDigestMismatch bool
+
+	SignatureChecked bool
+	Signed           bool
+
+	ReferrerArtifacts map[string]bool
+	Metadata          *ImageMetadata
+
+	MissingBlobs []string
+
+	StrictCredentials   bool
+	CredentialsMismatch bool
+
+	// interval is the time between the last check and the next one.
+	interval time.Duration
 }
 
 type ImageStore struct {
 	lock sync.RWMutex
 
-	imageSet map[string]ImageInfo
-	queue    *deque.Deque[string]
-	errQueue *deque.Deque[string]
+	imageSet map[ImageKey]ImageInfo
+	// credentialSets holds the credential sets each image is checked with.
+	credentialSets map[string]map[string]struct{}
+	schedule       *schedule
 
-	check checkFunc
+	check      checkFunc
+	registryOf registryFunc
 
-	concurrentNormalChecks int
-	concurrentErrorChecks  int
-}
+	// cooldowns hold the time until which checks of a rate limited registry are postponed.
+	cooldowns map[string]time.Time
+	// inFlight counts the checks of each registry that are in progress.
+	inFlight map[string]int
+	// wake is signaled when an image may have become ready for an idle worker.
+	wake chan struct{}
 
-type checkFunc func(imageName string) AvailabilityMode
-type gcFunc func(image string) []ContainerInfo
+	workers                int
+	maxInFlightPerRegistry int
 
-func NewImageStore(check checkFunc, concurrentNormalChecks, concurrentErrorChecks int) *ImageStore {
-	return &ImageStore{
-		imageSet: make(map[string]ImageInfo),
-		queue:    deque.New[string](2048, 2048),
-		errQueue: deque.New[string](512, 512),
+	checkInterval     time.Duration
+	maxCheckInterval  time.Duration
+	maxFailureBackoff time.Duration
 
-		check: check,
+	scheduleLag     prometheus.Histogram
+	completedChecks prometheus.Counter
+	now             func() time.Time
+}
 
-		concurrentNormalChecks: concurrentNormalChecks,
-		concurrentErrorChecks:  concurrentErrorChecks,
+type checkFunc func(key ImageKey) CheckResult
+type registryFunc func(imageName string) string
+type gcFunc func(key ImageKey) []ContainerInfo
+
+// defaultRateLimitCooldown is used when a rate limiting registry does not send the Retry-After header.
+const defaultRateLimitCooldown = time.Minute
+
+// idleWorkerInterval is how often an idle worker looks for due images, it limits the precision of check intervals.
+const idleWorkerInterval = time.Second
+
+// NewImageStore creates a store that checks images once they are due. New images are due immediately,
+// available images are re-checked every checkInterval, and the interval doubles up to maxCheckInterval
+// while the digest of an image stays the same. The interval of failing images doubles up to maxFailureBackoff.
+func NewImageStore(
+	check checkFunc,
+	registryOf registryFunc,
+	workers, maxInFlightPerRegistry int,
+	checkInterval, maxCheckInterval, maxFailureBackoff time.Duration,
+) *ImageStore {
+	return &ImageStore{
+		imageSet:       make(map[ImageKey]ImageInfo),
+		credentialSets: make(map[string]map[string]struct{}),
+		schedule:       newSchedule(),
+
+		check:      check,
+		registryOf: registryOf,
+
+		cooldowns: make(map[string]time.Time),
+		inFlight:  make(map[string]int),
+		wake:      make(chan struct{}, 1),
+
+		workers:                max(workers, 1),
+		maxInFlightPerRegistry: maxInFlightPerRegistry,
+
+		checkInterval:     checkInterval,
+		maxCheckInterval:  max(maxCheckInterval, checkInterval),
+		maxFailureBackoff: max(maxFailureBackoff, checkInterval),
+
+		scheduleLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "k8s_image_availability_exporter_check_schedule_lag_seconds",
+			Help:    "How long past its due time an image check started.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+		}),
+		completedChecks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "k8s_image_availability_exporter_completed_rechecks_total",
+			Help: "Number of image rechecks completed.",
+		}),
+		now: time.Now,
 	}
 }
 
 func (s *ImageStore) RunGC(gc gcFunc) {
 	go wait.Forever(func() {
+		s.collectGarbage(gc)
+	}, 5*time.Minute)
+}
+
+func (s *ImageStore) collectGarbage(gc gcFunc) {
+	s.lock.RLock()
+	keys := make([]ImageKey, 0, len(s.imageSet))
+	for key := range s.imageSet {
+		keys = append(keys, key)
+	}
+	s.lock.RUnlock()
+
+	// Container infos are collected without the lock, as it blocks checks and metrics. Only images whose
+	// container infos changed are collected once more under the lock, to not undo a reconcile in between.
+	for _, key := range keys {
+		if !s.containerInfoChanged(key, gc(key)) {
+			continue
+		}
+
 		s.lock.Lock()
-		defer s.lock.Unlock()
+		s.setContainerInfo(key, gc(key))
+		s.lock.Unlock()
+	}
+}
 
-		for image, imgInfo := range s.imageSet {
-			ci := gc(image)
+func (s *ImageStore) containerInfoChanged(key ImageKey, ci []ContainerInfo) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-			if len(ci) == 0 {
-				delete(s.imageSet, image)
+	imgInfo, ok := s.imageSet[key]
+	if !ok {
+		return false
+	}
 
-				continue
-			}
+	return !maps.Equal(imgInfo.ContainerInfo, containerInfoSliceToSet(ci))
+}
 
-			imgInfo.ContainerInfo = containerInfoSliceToSet(ci)
-			s.imageSet[image] = imgInfo
-		}
+func (s *ImageStore) setContainerInfo(key ImageKey, ci []ContainerInfo) {
+	imgInfo, ok := s.imageSet[key]
+	if !ok {
+		return
+	}
 
-	}, 5*time.Minute)
+	if len(ci) == 0 {
+		s.deleteImage(key)
+		return
+	}
+
+	imgInfo.ContainerInfo = containerInfoSliceToSet(ci)
+	s.imageSet[key] = imgInfo
 }
 
 func (s *ImageStore) ExtractMetrics() (ret []prometheus.Metric) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	for imageName, info := range s.imageSet {
+	// Metrics with the image label only are reported once per image, although the image may be checked
+	// with several credential sets.
+	images := make(map[string]ImageKey)
+
+	for key, info := range s.imageSet {
 		for containerInfo := range info.ContainerInfo {
-			ret = append(ret, newNamedConstMetrics(containerInfo.ControllerKind, containerInfo.ControllerName,
-				containerInfo.Namespace, containerInfo.Container, imageName, info.AvailMode)...)
+			if containerInfo.Revision != "" {
+				ret = append(ret, newRollbackConstMetric(containerInfo, key.Image, info.AvailMode))
+				continue
+			}
+
+			ret = append(ret, newNamedConstMetrics(containerInfo, key.Image, info.AvailMode, info.Reason)...)
+			if info.PinnedTag {
+				ret = append(ret, newContainerFlagConstMetric("tag_digest_mismatch", containerInfo, key.Image, info.TagDigestMismatch))
+			}
+			if info.StrictCredentials {
+				ret = append(ret, newContainerFlagConstMetric("credentials_mismatch", containerInfo, key.Image, info.CredentialsMismatch))
+			}
+		}
+
+		if prev, ok := images[key.Image]; !ok || s.preferredForImageMetrics(key, prev) {
+			images[key.Image] = key
+		}
+	}
+
+	for imageName, key := range images {
+		info := s.imageSet[key]
+
+		if info.Digest != "" {
+			ret = append(ret, newDigestConstMetrics(imageName, info)...)
+		}
+		if info.SignatureChecked {
+			ret = append(ret, newSignedConstMetric(imageName, info.Signed))
+		}
+		for artifactType, present := range info.ReferrerArtifacts {
+			ret = append(ret, newReferrerArtifactMissingConstMetric(imageName, artifactType, !present))
+		}
+		if info.Metadata != nil {
+			ret = append(ret, newMetadataConstMetrics(imageName, *info.Metadata)...)
+		}
+		for _, digest := range info.MissingBlobs {
+			ret = append(ret, newMissingBlobConstMetric(imageName, digest))
 		}
 	}
 
 	return
 }
 
-func (s *ImageStore) ReconcileImage(imageName string, containerInfos []ContainerInfo) {
+// ExtractScheduleMetrics returns the number of overdue images and the lag of the most overdue image per registry,
+// as well as the distribution of the lag of performed checks.
+func (s *ImageStore) ExtractScheduleMetrics() (ret []prometheus.Metric) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	type registryStats struct {
+		normal, error int
+		maxLag        time.Duration
+	}
+
+	now := s.now()
+	stats := make(map[string]*registryStats)
+	s.schedule.overdue(now, func(item *scheduledImage) {
+		st, ok := stats[item.registry]
+		if !ok {
+			st = &registryStats{}
+			stats[item.registry] = st
+		}
+
+		if s.imageSet[item.key].AvailMode == Available {
+			st.normal++
+		} else {
+			st.error++
+		}
+		st.maxLag = max(st.maxLag, now.Sub(item.due))
+	})
+
+	for registry, st := range stats {
+		for queue, depth := range map[string]int{"normal": st.normal, "error": st.error} {
+			ret = append(ret, prometheus.MustNewConstMetric(
+				prometheus.NewDesc(
+					"k8s_image_availability_exporter_registry_queue_depth",
+					"Number of images past their due time that wait to be checked per registry.",
+					nil,
+					prometheus.Labels{"registry": registry, "queue": queue},
+				),
+				prometheus.GaugeValue,
+				float64(depth),
+			))
+		}
+
+		ret = append(ret, prometheus.MustNewConstMetric(
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_registry_schedule_lag_seconds",
+				"How long past its due time the most overdue image of the registry waits to be checked.",
+				nil,
+				prometheus.Labels{"registry": registry},
+			),
+			prometheus.GaugeValue,
+			st.maxLag.Seconds(),
+		))
+	}
+
+	return append(ret, s.scheduleLag, s.completedChecks)
+}
+
+// ReconcileImage adds the image with the credential set to the store or updates its container infos,
+// true is returned for a new one. A container info belongs to a single credential set of the image, it is moved
+// from the other sets, e.g., once the pull secrets of the workload change.
+func (s *ImageStore) ReconcileImage(key ImageKey, containerInfos []ContainerInfo) bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	if len(containerInfos) == 0 {
-		return
+		return false
 	}
 
-	imageInfo, ok := s.imageSet[imageName]
+	for credentials := range s.credentialSets[key.Image] {
+		otherKey := ImageKey{Image: key.Image, Credentials: credentials}
+		if otherKey == key {
+			continue
+		}
+
+		otherInfo := s.imageSet[otherKey]
+		for _, ci := range containerInfos {
+			delete(otherInfo.ContainerInfo, ci)
+		}
+		if len(otherInfo.ContainerInfo) == 0 {
+			s.deleteImage(otherKey)
+		}
+	}
+
+	imageInfo, ok := s.imageSet[key]
 	if !ok {
 		containerInfoMap := containerInfoSliceToSet(containerInfos)
 
-		s.imageSet[imageName] = ImageInfo{ContainerInfo: containerInfoMap}
-		s.queue.PushBack(imageName)
+		registry := s.registryOf(key.Image)
+		s.imageSet[key] = ImageInfo{ContainerInfo: containerInfoMap, Registry: registry}
+		if s.credentialSets[key.Image] == nil {
+			s.credentialSets[key.Image] = make(map[string]struct{})
+		}
+		s.credentialSets[key.Image][key.Credentials] = struct{}{}
+		s.schedule.push(registry, key, s.now())
+		s.notify()
 
-		return
+		return true
 	}
 
 	for _, ci := range containerInfos {
 		imageInfo.ContainerInfo[ci] = struct{}{}
 	}
 
-	s.imageSet[imageName] = imageInfo
+	s.imageSet[key] = imageInfo
+
+	return false
 }
 
-func (s *ImageStore) Check() {
-	var (
-		normalChecks = s.concurrentNormalChecks
-		errChecks    = s.concurrentErrorChecks
-	)
+// deleteImage removes the image with the credential set from the store, the lock has to be held.
+func (s *ImageStore) deleteImage(key ImageKey) {
+	delete(s.imageSet, key)
+	s.schedule.remove(key)
 
-	if qLen := s.queue.Len(); qLen < s.concurrentNormalChecks {
-		normalChecks = qLen
+	delete(s.credentialSets[key.Image], key.Credentials)
+	if len(s.credentialSets[key.Image]) == 0 {
+		delete(s.credentialSets, key.Image)
 	}
-	if qLen := s.errQueue.Len(); qLen < s.concurrentErrorChecks {
-		errChecks = qLen
+}
+
+// Run starts the workers that check due images until the stop channel is closed. Each worker takes the next image
+// as soon as it is done with the previous one. Registries take turns, and registries that already have the maximum
+// number of checks in flight are skipped, so a slow registry cannot occupy all the workers.
+func (s *ImageStore) Run(stopCh <-chan struct{}) {
+	for range s.workers {
+		go func() {
+			for {
+				if s.checkNext() {
+					select {
+					case <-stopCh:
+						return
+					default:
+					}
+					continue
+				}
+
+				select {
+				case <-stopCh:
+					return
+				case <-s.wake:
+				case <-time.After(idleWorkerInterval):
+				}
+			}
+		}()
 	}
+}
 
-	errPops := s.popCheckPush(true, errChecks)
+// checkNext checks the next due image, false is returned if there is none.
+func (s *ImageStore) checkNext() bool {
+	s.lock.Lock()
+	item, ok := s.schedule.next(s.now(), func(registry string) bool {
+		return s.maxInFlightPerRegistry > 0 && s.inFlight[registry] >= s.maxInFlightPerRegistry
+	})
+	if ok {
+		s.inFlight[item.registry]++
+	}
+	s.lock.Unlock()
 
-	if errPops < errChecks {
-		normalChecks += errChecks - errPops
+	if !ok {
+		return false
+	}
+
+	s.checkImage(item)
+	s.completedChecks.Inc()
+
+	s.lock.Lock()
+	s.inFlight[item.registry]--
+	if s.inFlight[item.registry] == 0 {
+		delete(s.inFlight, item.registry)
 	}
+	s.lock.Unlock()
+	s.notify()
 
-	_ = s.popCheckPush(false, normalChecks)
+	return true
 }
 
-func (s *ImageStore) popCheckPush(errQ bool, count int) (pops int) {
-	for pops < count {
-		s.lock.Lock()
-		var imageRaw interface{}
-		if errQ {
-			imageRaw = s.errQueue.PopFront()
-		} else {
-			imageRaw = s.queue.PopFront()
-		}
-		pops++
-		image := imageRaw.(string)
+// notify wakes an idle worker up, if there is none, a busy worker looks for due images once it is done anyway.
+func (s *ImageStore) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
 
-		_, ok := s.imageSet[image]
-		if !ok {
-			s.lock.Unlock()
-			continue
-		}
+// CheckNow moves the image ahead of the other images of its registry, so that the next free worker checks it
+// within the in-flight limit of the registry instead of waiting for its turn. The image is rescheduled afterwards.
+func (s *ImageStore) CheckNow(key ImageKey) {
+	s.lock.Lock()
+	s.schedule.expedite(key, s.now())
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+func (s *ImageStore) checkImage(item checkItem) {
+	s.lock.Lock()
+	if _, ok := s.imageSet[item.key]; !ok {
+		s.lock.Unlock()
+		return
+	}
+
+	if cooldown := s.cooldowns[item.registry]; s.now().Before(cooldown) {
+		s.schedule.push(item.registry, item.key, cooldown)
 		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
 
-		availMode := s.check(image)
+	s.scheduleLag.Observe(s.now().Sub(item.due).Seconds())
 
-		s.lock.Lock()
+	result := s.check(item.key)
 
-		imageInfo, ok := s.imageSet[image]
-		if !ok {
-			s.lock.Unlock()
-			continue
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	imageInfo, ok := s.imageSet[item.key]
+	if !ok {
+		return
+	}
+
+	now := s.now()
+
+	if result.AvailMode == RateLimited {
+		cooldown := result.RetryAfter
+		if cooldown <= 0 {
+			cooldown = defaultRateLimitCooldown
 		}
-		imageInfo.AvailMode = availMode
-		s.imageSet[image] = imageInfo
+		s.cooldowns[item.registry] = now.Add(cooldown)
 
-		if availMode == Available {
-			s.queue.PushBack(image)
-		} else {
-			s.errQueue.PushBack(image)
+		// Keep the last known state of the image while the registry is throttling us.
+		if !imageInfo.LastCheck.IsZero() {
+			s.schedule.push(item.registry, item.key, now.Add(cooldown))
+			return
 		}
+	}
 
-		s.lock.Unlock()
+	imageInfo.interval = s.nextInterval(imageInfo, result)
+	imageInfo.AvailMode = result.AvailMode
+	imageInfo.Reason = result.Reason
+	imageInfo.StrictCredentials = result.StrictCredentials
+	imageInfo.CredentialsMismatch = result.CredentialsMismatch
+	imageInfo.MissingBlobs = result.MissingBlobs
+	// The tag and signatures can only be resolved when the digest is available, the last known state is kept otherwise.
+	if result.AvailMode == Available {
+		imageInfo.PinnedTag = result.PinnedTag
+		imageInfo.TagDigestMismatch = result.TagDigestMismatch
+		imageInfo.SignatureChecked = result.SignatureChecked
+		imageInfo.Signed = result.Signed
+		imageInfo.ReferrerArtifacts = result.ReferrerArtifacts
+		imageInfo.Metadata = result.Metadata
 	}
+	if result.Digest != "" {
+		if imageInfo.Digest != "" && imageInfo.Digest != result.Digest {
+			imageInfo.DigestChanges++
+			imageInfo.LastDigestChange = now
+		}
+		imageInfo.Digest = result.Digest
+	}
+	imageInfo.LastCheck = now
+	s.imageSet[item.key] = imageInfo
 
-	return
+	s.schedule.push(item.registry, item.key, now.Add(imageInfo.interval))
+}
+
+// preferredForImageMetrics reports whether metrics with the image label only are taken from the check with
+// the key rather than with the other key of the same image. Available checks are preferred, as they know the digest.
+func (s *ImageStore) preferredForImageMetrics(key, other ImageKey) bool {
+	available, otherAvailable := s.imageSet[key].AvailMode == Available, s.imageSet[other].AvailMode == Available
+	if available != otherAvailable {
+		return available
+	}
+
+	return key.Credentials < other.Credentials
+}
+
+// nextInterval doubles the interval while an available image keeps its digest or while an image keeps failing,
+// any other change of the check result resets the interval.
+func (s *ImageStore) nextInterval(prev ImageInfo, result CheckResult) time.Duration {
+	checked := !prev.LastCheck.IsZero()
+
+	switch {
+	case result.AvailMode == Available:
+		if checked && prev.AvailMode == Available && result.Digest != "" && result.Digest == prev.Digest {
+			return min(max(prev.interval*2, s.checkInterval), s.maxCheckInterval)
+		}
+	case checked && prev.AvailMode != Available:
+		return min(max(prev.interval*2, s.checkInterval), s.maxFailureBackoff)
+	}
+
+	return s.checkInterval
 }
 
 func containerInfoSliceToSet(containerInfos []ContainerInfo) map[ContainerInfo]struct{} {
@@ -211,18 +634,205 @@ func containerInfoSliceToSet(containerInfos []ContainerInfo) map[ContainerInfo]s
 	return containerInfoMap
 }
 
-func newNamedConstMetrics(ownerKind, ownerName, namespace, container, image string, avalMode AvailabilityMode) (ret []prometheus.Metric) {
+func newNamedConstMetrics(containerInfo ContainerInfo, image string, avalMode AvailabilityMode, reason string) (ret []prometheus.Metric) {
+	labels := map[string]string{
+		"namespace":      containerInfo.Namespace,
+		"container":      containerInfo.Container,
+		"container_type": containerInfo.ContainerType,
+		"volume":         containerInfo.Volume,
+		"image":          image,
+		"kind":           strings.ToLower(containerInfo.ControllerKind),
+		"name":           containerInfo.ControllerName,
+	}
+
+	ret = getMetric(labels, avalMode)
+	if reason != "" {
+		ret = append(ret, newReasonConstMetric(labels, avalMode, reason))
+	}
+
+	return ret
+}
+
+// newReasonConstMetric returns an info metric that refines the availability mode, it is separate from
+// the availability metrics, so that their label sets stay the same when the mode changes.
+func newReasonConstMetric(labels map[string]string, mode AvailabilityMode, reason string) prometheus.Metric {
+	reasonLabels := make(map[string]string, len(labels)+2)
+	for k, v := range labels {
+		reasonLabels[k] = v
+	}
+	reasonLabels["availability_mode"] = mode.String()
+	reasonLabels["reason"] = reason
+
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_reason", "", nil, reasonLabels),
+		prometheus.GaugeValue,
+		1,
+	)
+}
+
+func newRollbackConstMetric(containerInfo ContainerInfo, image string, avalMode AvailabilityMode) prometheus.Metric {
+	labels := map[string]string{
+		"namespace":      containerInfo.Namespace,
+		"container":      containerInfo.Container,
+		"container_type": containerInfo.ContainerType,
+		"volume":         containerInfo.Volume,
+		"image":          image,
+		"kind":           strings.ToLower(containerInfo.ControllerKind),
+		"name":           containerInfo.ControllerName,
+		"revision":       containerInfo.Revision,
+	}
+
+	var value float64
+	if avalMode == Available {
+		value = 1
+	}
+
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_rollback_available", "", nil, labels),
+		prometheus.GaugeValue,
+		value,
+	)
+}
+
+// newContainerFlagConstMetric returns a metric with the labels of the availability metrics, its value is 1 if the flag is set.
+func newContainerFlagConstMetric(name string, containerInfo ContainerInfo, image string, flag bool) prometheus.Metric {
 	labels := map[string]string{
-		"namespace": namespace,
-		"container": container,
-		"image":     image,
-		"kind":      strings.ToLower(ownerKind),
-		"name":      ownerName,
+		"namespace":      containerInfo.Namespace,
+		"container":      containerInfo.Container,
+		"container_type": containerInfo.ContainerType,
+		"volume":         containerInfo.Volume,
+		"image":          image,
+		"kind":           strings.ToLower(containerInfo.ControllerKind),
+		"name":           containerInfo.ControllerName,
+	}
+
+	var value float64
+	if flag {
+		value = 1
+	}
+
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_"+name, "", nil, labels),
+		prometheus.GaugeValue,
+		value,
+	)
+}
+
+// newDigestConstMetrics returns the digest the image resolved to and how often it changed, so that re-pushes of
+// mutable tags are visible.
+func newDigestConstMetrics(image string, info ImageInfo) []prometheus.Metric {
+	var lastChange float64
+	if !info.LastDigestChange.IsZero() {
+		lastChange = float64(info.LastDigestChange.Unix())
+	}
+
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_digest", "", nil, prometheus.Labels{"image": image, "digest": info.Digest}),
+			prometheus.GaugeValue,
+			1,
+		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_digest_changes_total", "", nil, prometheus.Labels{"image": image}),
+			prometheus.CounterValue,
+			float64(info.DigestChanges),
+		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_digest_last_change_timestamp_seconds", "", nil, prometheus.Labels{"image": image}),
+			prometheus.GaugeValue,
+			lastChange,
+		),
+	}
+}
+
+func newSignedConstMetric(image string, signed bool) prometheus.Metric {
+	var value float64
+	if signed {
+		value = 1
+	}
+
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_signed", "", nil, prometheus.Labels{"image": image}),
+		prometheus.GaugeValue,
+		value,
+	)
+}
+
+func newReferrerArtifactMissingConstMetric(image, artifactType string, missing bool) prometheus.Metric {
+	var value float64
+	if missing {
+		value = 1
+	}
+
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_referrer_artifact_missing", "", nil, prometheus.Labels{"image": image, "artifact_type": artifactType}),
+		prometheus.GaugeValue,
+		value,
+	)
+}
+
+func newMissingBlobConstMetric(image, digest string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(
+		prometheus.NewDesc("k8s_image_availability_exporter_missing_blob", "", nil, prometheus.Labels{"image": image, "digest": digest}),
+		prometheus.GaugeValue,
+		1,
+	)
+}
+
+// newMetadataConstMetrics returns the age, size and layer count of the image, and an info metric with
+// the selected annotations as labels.
+func newMetadataConstMetrics(image string, metadata ImageMetadata) []prometheus.Metric {
+	var created float64
+	if !metadata.Created.IsZero() {
+		created = float64(metadata.Created.Unix())
+	}
+
+	infoLabels := prometheus.Labels{"image": image}
+	for annotation, value := range metadata.Annotations {
+		infoLabels[annotationLabelName(annotation)] = value
 	}
 
-	return getMetric(labels, avalMode)
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_created_timestamp_seconds", "", nil, prometheus.Labels{"image": image}),
+			prometheus.GaugeValue,
+			created,
+		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_compressed_size_bytes", "", nil, prometheus.Labels{"image": image}),
+			prometheus.GaugeValue,
+			float64(metadata.CompressedSize),
+		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_layers", "", nil, prometheus.Labels{"image": image}),
+			prometheus.GaugeValue,
+			float64(metadata.Layers),
+		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc("k8s_image_availability_exporter_image_info", "", nil, infoLabels),
+			prometheus.GaugeValue,
+			1,
+		),
+	}
+}
+
+// annotationLabelName turns an annotation into a label name, the "org.opencontainers.image." prefix is dropped,
+// e.g., "org.opencontainers.image.source" becomes "source".
+func annotationLabelName(annotation string) string {
+	annotation = strings.TrimPrefix(annotation, "org.opencontainers.image.")
+	if annotation == "" || annotation[0] >= '0' && annotation[0] <= '9' {
+		annotation = "_" + annotation
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, annotation)
 }
 
+// getMetric returns a metric per availability mode. The reason is only set on the metric of the current mode.
 func getMetric(labels map[string]string, mode AvailabilityMode) (ret []prometheus.Metric) {
 	for availMode, desc := range AvailabilityModeDescMap {
 		var value float64
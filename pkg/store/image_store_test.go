@@ -3,9 +3,12 @@ package store
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -14,15 +17,15 @@ func insertImagesIntoStore(t *testing.T, store *ImageStore, successfulChecks, fa
 	t.Helper()
 
 	for i := 0; i < successfulChecks; i++ {
-		store.ReconcileImage(fmt.Sprintf("test_%d", i), info)
+		store.ReconcileImage(ImageKey{Image: fmt.Sprintf("test_%d", i)}, info)
 	}
 	for i := 0; i < failedChecks; i++ {
-		store.ReconcileImage(fmt.Sprintf("fail_%d", i), info)
+		store.ReconcileImage(ImageKey{Image: fmt.Sprintf("fail_%d", i)}, info)
 	}
 }
 
 func TestImageStore_AddOrUpdateImage(t *testing.T) {
-	store := NewImageStore(reconcile(t), 2, 3)
+	store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
 
 	info := []ContainerInfo{
 		{
@@ -41,33 +44,37 @@ func TestImageStore_AddOrUpdateImage(t *testing.T) {
 
 	insertImagesIntoStore(t, store, 3, 2, info)
 
-	store.Check()
+	checkDue(store)
 
 	metrics := store.ExtractMetrics()
-	require.Len(t, metrics, 70)
+	require.Len(t, metrics, 150)
 }
 
-func reconcile(t *testing.T) func(imageName string) AvailabilityMode {
+func reconcile(t *testing.T) func(key ImageKey) CheckResult {
 	t.Helper()
 
-	return func(imageName string) AvailabilityMode {
-		if strings.HasPrefix(imageName, "fail_") {
-			return UnknownError
+	return func(key ImageKey) CheckResult {
+		if strings.HasPrefix(key.Image, "fail_") {
+			return CheckResult{AvailMode: UnknownError}
 		}
 
-		return Available
+		return CheckResult{AvailMode: Available}
 	}
 }
 
+func testRegistry(string) string {
+	return "registry.test"
+}
+
 func TestImageStore_ExtractMetrics(t *testing.T) {
 	t.Parallel()
 
 	t.Run("no images", func(t *testing.T) {
 		t.Parallel()
 
-		store := NewImageStore(reconcile(t), 2, 3)
+		store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
 		insertImagesIntoStore(t, store, 0, 0, nil)
-		store.Check()
+		checkDue(store)
 
 		metrics := store.ExtractMetrics()
 		assert.Empty(t, metrics)
@@ -76,7 +83,7 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 	t.Run("one container", func(t *testing.T) {
 		t.Parallel()
 
-		store := NewImageStore(reconcile(t), 2, 3)
+		store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
 
 		info := []ContainerInfo{
 			{
@@ -84,6 +91,7 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				ControllerKind: "Deployment",
 				ControllerName: "test_name",
 				Container:      "test_container",
+				ContainerType:  ContainerTypeRegular,
 			},
 		}
 
@@ -93,11 +101,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -105,11 +115,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -117,11 +129,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -129,11 +143,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -141,11 +157,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -153,11 +171,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -165,17 +185,131 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_repository_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_manifest_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_repository_name",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_tag",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_rate_limited",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_platform_mismatch",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_blob_missing",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_pull_blocked",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 		}
 
 		insertImagesIntoStore(t, store, 1, 0, info)
-		store.Check()
+		checkDue(store)
 
 		metrics := store.ExtractMetrics()
 		require.Len(t, metrics, len(expectedMetrics))
@@ -196,7 +330,7 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 	t.Run("two containers, different kind", func(t *testing.T) {
 		t.Parallel()
 
-		store := NewImageStore(reconcile(t), 2, 3)
+		store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
 
 		info := []ContainerInfo{
 			{
@@ -204,12 +338,14 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				ControllerKind: "Deployment",
 				ControllerName: "test_name",
 				Container:      "test_container",
+				ContainerType:  ContainerTypeRegular,
 			},
 			{
 				Namespace:      "test_ns2",
 				ControllerKind: "StatefulSet",
 				ControllerName: "test_name2",
 				Container:      "test_container2",
+				ContainerType:  ContainerTypeInit,
 			},
 		}
 
@@ -219,11 +355,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -231,11 +369,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -243,11 +383,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -255,11 +397,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -267,11 +411,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -279,11 +425,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -291,11 +439,125 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container",
-					"image":     "test_0",
-					"kind":      "deployment",
-					"name":      "test_name",
-					"namespace": "test_ns",
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_repository_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_manifest_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_repository_name",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_tag",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_rate_limited",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_platform_mismatch",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_blob_missing",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_pull_blocked",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container",
+					"container_type": "regular",
+					"image":          "test_0",
+					"kind":           "deployment",
+					"name":           "test_name",
+					"namespace":      "test_ns",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -303,11 +565,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -315,11 +579,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -327,11 +593,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -339,11 +607,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -351,11 +621,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -363,11 +635,13 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 			prometheus.NewDesc(
@@ -375,17 +649,131 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 				"",
 				nil,
 				prometheus.Labels{
-					"container": "test_container2",
-					"image":     "test_0",
-					"kind":      "statefulset",
-					"name":      "test_name2",
-					"namespace": "test_ns2",
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_repository_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_manifest_absent",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_repository_name",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_bad_tag",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_rate_limited",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_platform_mismatch",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_blob_missing",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
+				},
+			),
+			prometheus.NewDesc(
+				"k8s_image_availability_exporter_pull_blocked",
+				"",
+				nil,
+				prometheus.Labels{
+					"container":      "test_container2",
+					"container_type": "init",
+					"image":          "test_0",
+					"kind":           "statefulset",
+					"name":           "test_name2",
+					"namespace":      "test_ns2",
+					"volume":         "",
 				},
 			),
 		}
 
 		insertImagesIntoStore(t, store, 1, 0, info)
-		store.Check()
+		checkDue(store)
 
 		metrics := store.ExtractMetrics()
 		require.Len(t, metrics, len(expectedMetrics))
@@ -402,4 +790,780 @@ func TestImageStore_ExtractMetrics(t *testing.T) {
 
 		assert.ElementsMatch(t, expectedMetricsStr, returnedMetricsStr)
 	})
+	t.Run("rollback revision", func(t *testing.T) {
+		t.Parallel()
+
+		store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+
+		info := []ContainerInfo{
+			{
+				Namespace:      "test_ns",
+				ControllerKind: "Deployment",
+				ControllerName: "test_name",
+				Container:      "test_container",
+				ContainerType:  ContainerTypeRegular,
+				Revision:       "3",
+			},
+		}
+
+		insertImagesIntoStore(t, store, 1, 0, info)
+		checkDue(store)
+
+		metrics := store.ExtractMetrics()
+		require.Len(t, metrics, 1)
+
+		expectedDesc := prometheus.NewDesc(
+			"k8s_image_availability_exporter_rollback_available",
+			"",
+			nil,
+			prometheus.Labels{
+				"container":      "test_container",
+				"container_type": "regular",
+				"image":          "test_0",
+				"kind":           "deployment",
+				"name":           "test_name",
+				"namespace":      "test_ns",
+				"revision":       "3",
+				"volume":         "",
+			},
+		)
+		assert.Equal(t, expectedDesc.String(), metrics[0].Desc().String())
+	})
+}
+
+func TestImageStore_RateLimited(t *testing.T) {
+	var (
+		checks      int
+		rateLimited bool
+	)
+	check := func(ImageKey) CheckResult {
+		checks++
+		if rateLimited {
+			return CheckResult{AvailMode: RateLimited, RetryAfter: time.Hour}
+		}
+		return CheckResult{AvailMode: Available}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 2, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	checkDue(store)
+	require.Equal(t, 2, checks)
+
+	rateLimited = true
+	clock.advance(time.Minute)
+	checkDue(store)
+	// The first check puts the whole registry into a cooldown, the second image is not checked.
+	require.Equal(t, 3, checks)
+
+	for image, info := range store.imageSet {
+		assert.Equal(t, Available, info.AvailMode, image)
+	}
+
+	checkDue(store)
+	require.Equal(t, 3, checks)
+}
+
+func TestImageStore_CheckWorkers(t *testing.T) {
+	t.Parallel()
+
+	const (
+		images     = 8
+		checkDelay = 50 * time.Millisecond
+	)
+
+	checkWithWorkers := func(t *testing.T, workers int) (time.Duration, int32) {
+		t.Helper()
+
+		var inFlight, peak atomic.Int32
+		check := func(ImageKey) CheckResult {
+			current := inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			for {
+				prev := peak.Load()
+				if current <= prev || peak.CompareAndSwap(prev, current) {
+					break
+				}
+			}
+
+			time.Sleep(checkDelay)
+			return CheckResult{AvailMode: Available}
+		}
+
+		store := NewImageStore(check, testRegistry, workers, 0, time.Minute, time.Hour, 10*time.Minute)
+		insertImagesIntoStore(t, store, images, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+
+		start := time.Now()
+		store.Run(stopCh)
+		require.Eventually(t, func() bool { return checkedImages(store) == images }, 10*time.Second, time.Millisecond)
+
+		return time.Since(start), peak.Load()
+	}
+
+	sequential, sequentialPeak := checkWithWorkers(t, 1)
+	concurrent, concurrentPeak := checkWithWorkers(t, images)
+
+	assert.Equal(t, int32(1), sequentialPeak)
+	assert.Equal(t, int32(images), concurrentPeak)
+	assert.GreaterOrEqual(t, sequential, images*checkDelay)
+	assert.Less(t, concurrent, sequential/2)
+}
+
+// checkDue checks all due images one by one, the way a single worker does.
+func checkDue(store *ImageStore) {
+	for store.checkNext() {
+	}
+}
+
+func checkedImages(store *ImageStore) (checked int) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, info := range store.imageSet {
+		if !info.LastCheck.IsZero() {
+			checked++
+		}
+	}
+
+	return checked
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock(store *ImageStore) *testClock {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store.now = func() time.Time { return clock.now }
+
+	return clock
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestImageStore_CheckSchedule(t *testing.T) {
+	var (
+		checked []string
+		digest  = "sha256:1"
+	)
+	check := func(key ImageKey) CheckResult {
+		checked = append(checked, key.Image)
+		if strings.HasPrefix(key.Image, "fail_") {
+			return CheckResult{AvailMode: UnknownError}
+		}
+		return CheckResult{AvailMode: Available, Digest: digest}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, 4*time.Minute, 2*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 1, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	tick := func(d time.Duration) []string {
+		t.Helper()
+
+		checked = nil
+		clock.advance(d)
+		checkDue(store)
+
+		return checked
+	}
+
+	// New images are due immediately.
+	require.ElementsMatch(t, []string{"test_0", "fail_0"}, tick(0))
+	require.Empty(t, tick(59*time.Second))
+
+	// Both images are re-checked after the base interval.
+	require.ElementsMatch(t, []string{"test_0", "fail_0"}, tick(time.Second))
+	assert.Equal(t, 2*time.Minute, store.imageSet[ImageKey{Image: "test_0"}].interval)
+	assert.Equal(t, 2*time.Minute, store.imageSet[ImageKey{Image: "fail_0"}].interval)
+
+	require.ElementsMatch(t, []string{"test_0", "fail_0"}, tick(2*time.Minute))
+	// The stable image keeps backing off up to its own limit, the failing one is capped earlier.
+	assert.Equal(t, 4*time.Minute, store.imageSet[ImageKey{Image: "test_0"}].interval)
+	assert.Equal(t, 2*time.Minute, store.imageSet[ImageKey{Image: "fail_0"}].interval)
+
+	require.Equal(t, []string{"fail_0"}, tick(2*time.Minute))
+
+	// A new digest resets the interval.
+	digest = "sha256:2"
+	require.ElementsMatch(t, []string{"test_0", "fail_0"}, tick(2*time.Minute))
+	assert.Equal(t, time.Minute, store.imageSet[ImageKey{Image: "test_0"}].interval)
+	assert.Equal(t, "sha256:2", store.imageSet[ImageKey{Image: "test_0"}].Digest)
+}
+
+func TestImageStore_ScheduleLag(t *testing.T) {
+	store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 2, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	clock.advance(30 * time.Second)
+	// Only one image is checked, the other one stays overdue.
+	require.True(t, store.checkNext())
+
+	values := make(map[string]float64)
+	for _, m := range store.ExtractScheduleMetrics() {
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+
+		switch {
+		case metric.Histogram != nil:
+			require.Equal(t, uint64(1), metric.Histogram.GetSampleCount())
+			values["histogram"] = metric.Histogram.GetSampleSum()
+		case metric.Gauge != nil:
+			key := m.Desc().String()
+			for _, label := range metric.Label {
+				key += "," + label.GetName() + "=" + label.GetValue()
+			}
+			values[key] = metric.Gauge.GetValue()
+		}
+	}
+
+	assert.Equal(t, 30.0, values["histogram"])
+
+	var depth, lag float64
+	for key, value := range values {
+		switch {
+		case strings.Contains(key, "registry_queue_depth") && strings.Contains(key, "queue=normal"):
+			depth = value
+		case strings.Contains(key, "registry_schedule_lag_seconds"):
+			lag = value
+		}
+	}
+	assert.Equal(t, 1.0, depth)
+	assert.Equal(t, 30.0, lag)
+}
+
+func TestImageStore_CheckRegistriesRoundRobin(t *testing.T) {
+	var checked []string
+	check := func(key ImageKey) CheckResult {
+		checked = append(checked, key.Image)
+		return CheckResult{AvailMode: Available}
+	}
+	registryOf := func(imageName string) string {
+		return strings.SplitN(imageName, "/", 2)[0]
+	}
+
+	store := NewImageStore(check, registryOf, 1, 1, time.Minute, time.Hour, 10*time.Minute)
+	info := []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}}
+	for i := 0; i < 4; i++ {
+		store.ReconcileImage(ImageKey{Image: fmt.Sprintf("busy.test/image_%d", i)}, info)
+	}
+	store.ReconcileImage(ImageKey{Image: "quiet.test/image"}, info)
+
+	// A registry with many images must not keep others waiting until all of its images are checked.
+	checkDue(store)
+	require.ElementsMatch(t, []string{"busy.test/image_0", "quiet.test/image"}, checked[:2])
+	require.Equal(t, []string{"busy.test/image_1", "busy.test/image_2", "busy.test/image_3"}, checked[2:])
+}
+
+func TestImageStore_CheckSlowRegistry(t *testing.T) {
+	release := make(chan struct{})
+	check := func(key ImageKey) CheckResult {
+		if strings.HasPrefix(key.Image, "slow.test/") {
+			<-release
+		}
+		return CheckResult{AvailMode: Available}
+	}
+	registryOf := func(imageName string) string {
+		return strings.SplitN(imageName, "/", 2)[0]
+	}
+
+	store := NewImageStore(check, registryOf, 2, 1, time.Minute, time.Hour, 10*time.Minute)
+	info := []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}}
+	for i := 0; i < 3; i++ {
+		store.ReconcileImage(ImageKey{Image: fmt.Sprintf("slow.test/image_%d", i)}, info)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	store.Run(stopCh)
+
+	// Images of other registries, including new ones, are checked while the slow registry is at its limit.
+	for i := 0; i < 3; i++ {
+		store.ReconcileImage(ImageKey{Image: fmt.Sprintf("fast.test/image_%d", i)}, info)
+	}
+	require.Eventually(t, func() bool { return checkedImages(store) == 3 }, 10*time.Second, time.Millisecond)
+
+	close(release)
+	require.Eventually(t, func() bool { return checkedImages(store) == 6 }, 10*time.Second, time.Millisecond)
+}
+
+func TestImageStore_CheckNow(t *testing.T) {
+	var checked []string
+	check := func(key ImageKey) CheckResult {
+		checked = append(checked, key.Image)
+		return CheckResult{AvailMode: Available}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 1, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	for _, image := range []string{"test_0", "test_1"} {
+		require.True(t, store.ReconcileImage(ImageKey{Image: image}, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: image, Container: "test"}}))
+	}
+	checkDue(store)
+	require.Equal(t, []string{"test_0", "test_1"}, checked)
+
+	clock.advance(30 * time.Second)
+	store.CheckNow(ImageKey{Image: "test_1"})
+	store.CheckNow(ImageKey{Image: "unknown"})
+	checkDue(store)
+	require.Equal(t, []string{"test_0", "test_1", "test_1"}, checked)
+	assert.Equal(t, clock.now, store.imageSet[ImageKey{Image: "test_1"}].LastCheck)
+
+	// The image is checked ahead of overdue ones, but within the in-flight limit of the registry.
+	clock.advance(time.Minute)
+	store.CheckNow(ImageKey{Image: "test_1"})
+	store.inFlight["registry.test"] = 1
+	checkDue(store)
+	require.Len(t, checked, 3)
+
+	delete(store.inFlight, "registry.test")
+	require.True(t, store.checkNext())
+	require.Equal(t, "test_1", checked[3])
+
+	// The image is rescheduled after the immediate check, so it is not checked twice.
+	checkDue(store)
+	require.Equal(t, []string{"test_0", "test_1", "test_1", "test_1", "test_0"}, checked)
+	clock.advance(30 * time.Second)
+	checkDue(store)
+	require.Len(t, checked, 5)
+}
+
+func TestImageStore_DigestChanges(t *testing.T) {
+	var result CheckResult
+	check := func(ImageKey) CheckResult {
+		return result
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	digestMetrics := func() map[string]float64 {
+		t.Helper()
+
+		ret := make(map[string]float64)
+		for _, m := range store.ExtractMetrics() {
+			desc := m.Desc().String()
+			if !strings.Contains(desc, "image_digest") {
+				continue
+			}
+
+			metric := &dto.Metric{}
+			require.NoError(t, m.Write(metric))
+
+			key := desc[strings.Index(desc, `"`)+1:]
+			key = key[:strings.Index(key, `"`)]
+			for _, label := range metric.Label {
+				if label.GetName() == "digest" {
+					key += "{" + label.GetValue() + "}"
+				}
+			}
+			if metric.Counter != nil {
+				ret[key] = metric.Counter.GetValue()
+			} else {
+				ret[key] = metric.Gauge.GetValue()
+			}
+		}
+
+		return ret
+	}
+
+	result = CheckResult{AvailMode: Available, Digest: "sha256:1"}
+	checkDue(store)
+	assert.Equal(t, map[string]float64{
+		"k8s_image_availability_exporter_image_digest{sha256:1}":                     1,
+		"k8s_image_availability_exporter_image_digest_changes_total":                 0,
+		"k8s_image_availability_exporter_image_digest_last_change_timestamp_seconds": 0,
+	}, digestMetrics())
+
+	// A failed check keeps the last known digest.
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: RegistryUnavailable}
+	checkDue(store)
+	assert.Equal(t, "sha256:1", store.imageSet[ImageKey{Image: "test_0"}].Digest)
+
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: Available, Digest: "sha256:2"}
+	checkDue(store)
+	assert.Equal(t, map[string]float64{
+		"k8s_image_availability_exporter_image_digest{sha256:2}":                     1,
+		"k8s_image_availability_exporter_image_digest_changes_total":                 1,
+		"k8s_image_availability_exporter_image_digest_last_change_timestamp_seconds": float64(clock.now.Unix()),
+	}, digestMetrics())
+}
+
+func TestImageStore_TagDigestMismatch(t *testing.T) {
+	result := CheckResult{AvailMode: Available, PinnedTag: true, TagDigestMismatch: true}
+	check := func(ImageKey) CheckResult {
+		return result
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	mismatch := func() (float64, bool) {
+		t.Helper()
+
+		for _, m := range store.ExtractMetrics() {
+			if !strings.Contains(m.Desc().String(), "k8s_image_availability_exporter_tag_digest_mismatch") {
+				continue
+			}
+
+			metric := &dto.Metric{}
+			require.NoError(t, m.Write(metric))
+
+			return metric.Gauge.GetValue(), true
+		}
+
+		return 0, false
+	}
+
+	checkDue(store)
+	value, ok := mismatch()
+	require.True(t, ok)
+	assert.Equal(t, 1.0, value)
+
+	// The last known state is kept while the digest is unavailable.
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: RegistryUnavailable}
+	checkDue(store)
+	value, ok = mismatch()
+	require.True(t, ok)
+	assert.Equal(t, 1.0, value)
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_registry_unavailable"))
+}
+
+func TestImageStore_Signed(t *testing.T) {
+	result := CheckResult{AvailMode: Available}
+	check := func(ImageKey) CheckResult {
+		return result
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	checkDue(store)
+	for _, m := range store.ExtractMetrics() {
+		assert.NotContains(t, m.Desc().String(), "k8s_image_availability_exporter_signed", "unchecked images have no signature metric")
+	}
+
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: Available, SignatureChecked: true}
+	checkDue(store)
+	assert.Equal(t, 0.0, gaugeValue(t, store, "k8s_image_availability_exporter_signed"))
+
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: Available, SignatureChecked: true, Signed: true}
+	checkDue(store)
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_signed"))
+
+	// The last known state is kept while the digest is unavailable.
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: RegistryUnavailable}
+	checkDue(store)
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_signed"))
+}
+
+func TestImageStore_ReferrerArtifacts(t *testing.T) {
+	check := func(ImageKey) CheckResult {
+		return CheckResult{AvailMode: Available, ReferrerArtifacts: map[string]bool{"application/spdx+json": true, "https://slsa.dev/provenance/v1": false}}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+	checkDue(store)
+
+	missing := make(map[string]float64)
+	for _, m := range store.ExtractMetrics() {
+		if !strings.Contains(m.Desc().String(), "k8s_image_availability_exporter_referrer_artifact_missing") {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+		for _, label := range metric.Label {
+			if label.GetName() == "artifact_type" {
+				missing[label.GetValue()] = metric.Gauge.GetValue()
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]float64{"application/spdx+json": 0, "https://slsa.dev/provenance/v1": 1}, missing)
+}
+
+func TestImageStore_MissingBlobs(t *testing.T) {
+	missingBlobs := []string{"sha256:1", "sha256:2"}
+	check := func(ImageKey) CheckResult {
+		return CheckResult{AvailMode: BlobMissing, Reason: "blob_missing", MissingBlobs: missingBlobs}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	digests := func() (ret []string) {
+		for _, m := range store.ExtractMetrics() {
+			if !strings.Contains(m.Desc().String(), "k8s_image_availability_exporter_missing_blob") {
+				continue
+			}
+
+			metric := &dto.Metric{}
+			require.NoError(t, m.Write(metric))
+			for _, label := range metric.Label {
+				if label.GetName() == "digest" {
+					ret = append(ret, label.GetValue())
+				}
+			}
+		}
+		return
+	}
+
+	checkDue(store)
+	assert.ElementsMatch(t, []string{"sha256:1", "sha256:2"}, digests())
+
+	// The blobs are back, e.g., the image was pushed again.
+	missingBlobs = nil
+	clock.advance(time.Hour)
+	checkDue(store)
+	assert.Empty(t, digests())
+}
+
+func TestImageStore_Metadata(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	check := func(ImageKey) CheckResult {
+		return CheckResult{AvailMode: Available, Metadata: &ImageMetadata{
+			Created:        created,
+			CompressedSize: 4096,
+			Layers:         3,
+			Annotations:    map[string]string{"org.opencontainers.image.revision": "abc123", "com.example.team": ""},
+		}}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+	checkDue(store)
+
+	assert.Equal(t, float64(created.Unix()), gaugeValue(t, store, "k8s_image_availability_exporter_image_created_timestamp_seconds"))
+	assert.Equal(t, 4096.0, gaugeValue(t, store, "k8s_image_availability_exporter_image_compressed_size_bytes"))
+	assert.Equal(t, 3.0, gaugeValue(t, store, "k8s_image_availability_exporter_image_layers"))
+
+	for _, m := range store.ExtractMetrics() {
+		if !strings.Contains(m.Desc().String(), `"k8s_image_availability_exporter_image_info"`) {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+
+		labels := make(map[string]string)
+		for _, label := range metric.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		assert.Equal(t, map[string]string{"image": "test_0", "revision": "abc123", "com_example_team": ""}, labels)
+	}
+}
+
+func TestImageStore_CredentialSets(t *testing.T) {
+	check := func(key ImageKey) CheckResult {
+		if key.Credentials == "" {
+			return CheckResult{AvailMode: AuthnFailure}
+		}
+		return CheckResult{AvailMode: Available, Digest: "sha256:1"}
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	store.ReconcileImage(ImageKey{Image: "test"}, []ContainerInfo{{Namespace: "b", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+	store.ReconcileImage(ImageKey{Image: "test", Credentials: "a/regcred"}, []ContainerInfo{{Namespace: "a", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+	checkDue(store)
+
+	available := make(map[string]float64)
+	digestMetrics := 0
+	for _, m := range store.ExtractMetrics() {
+		desc := m.Desc().String()
+		if strings.Contains(desc, `"k8s_image_availability_exporter_image_digest"`) {
+			digestMetrics++
+		}
+		if !strings.Contains(desc, `"k8s_image_availability_exporter_available"`) {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+		for _, label := range metric.Label {
+			if label.GetName() == "namespace" {
+				available[label.GetValue()] = metric.Gauge.GetValue()
+			}
+		}
+	}
+
+	// Each workload gets the result of the check with its own credentials.
+	assert.Equal(t, map[string]float64{"a": 1, "b": 0}, available)
+	assert.Equal(t, 1, digestMetrics)
+}
+
+func TestImageStore_CredentialsMismatch(t *testing.T) {
+	result := CheckResult{AvailMode: Available}
+	check := func(ImageKey) CheckResult {
+		return result
+	}
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	insertImagesIntoStore(t, store, 1, 0, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	checkDue(store)
+	for _, m := range store.ExtractMetrics() {
+		assert.NotContains(t, m.Desc().String(), "k8s_image_availability_exporter_credentials_mismatch", "only strict checks report mismatches")
+	}
+
+	clock.advance(time.Minute)
+	result = CheckResult{AvailMode: AuthnFailure, StrictCredentials: true, CredentialsMismatch: true}
+	checkDue(store)
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_credentials_mismatch"))
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_authentication_failure"))
+}
+
+func gaugeValue(t *testing.T, store *ImageStore, name string) float64 {
+	t.Helper()
+
+	for _, m := range store.ExtractMetrics() {
+		if !strings.Contains(m.Desc().String(), `"`+name+`"`) {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		require.NoError(t, m.Write(metric))
+
+		return metric.Gauge.GetValue()
+	}
+
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+type storeCollector struct {
+	store *ImageStore
+}
+
+func (c storeCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.store.ExtractMetrics() {
+		ch <- m
+	}
+}
+
+func TestImageStore_CredentialSetChange(t *testing.T) {
+	store := NewImageStore(reconcile(t), testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	info := []ContainerInfo{{Namespace: "a", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}}
+
+	store.ReconcileImage(ImageKey{Image: "test"}, info)
+	store.ReconcileImage(ImageKey{Image: "test", Credentials: "a/regcred"}, info)
+	checkDue(store)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(storeCollector{store})
+	families, err := registry.Gather()
+	require.NoError(t, err, "a container is reported under a single credential set")
+
+	for _, family := range families {
+		if family.GetName() == "k8s_image_availability_exporter_available" {
+			assert.Len(t, family.Metric, 1)
+		}
+	}
+	assert.Len(t, store.imageSet, 1)
+	assert.Contains(t, store.imageSet, ImageKey{Image: "test", Credentials: "a/regcred"})
+}
+
+func TestImageStore_Reason(t *testing.T) {
+	result := CheckResult{AvailMode: RegistryUnavailable, Reason: "dns"}
+	check := func(ImageKey) CheckResult { return result }
+
+	store := NewImageStore(check, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	clock := newTestClock(store)
+	store.ReconcileImage(ImageKey{Image: "test"}, []ContainerInfo{{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}})
+
+	availabilitySeries := func() (series []string, reasons []string) {
+		t.Helper()
+
+		for _, m := range store.ExtractMetrics() {
+			metric := &dto.Metric{}
+			require.NoError(t, m.Write(metric))
+
+			labels := m.Desc().String()
+			if strings.Contains(labels, `"k8s_image_availability_exporter_reason"`) {
+				for _, label := range metric.Label {
+					if label.GetName() == "reason" {
+						reasons = append(reasons, label.GetValue())
+					}
+				}
+				continue
+			}
+			series = append(series, labels)
+		}
+
+		return series, reasons
+	}
+
+	checkDue(store)
+	before, reasons := availabilitySeries()
+	assert.Equal(t, []string{"dns"}, reasons)
+	assert.Equal(t, 1.0, gaugeValue(t, store, "k8s_image_availability_exporter_registry_unavailable"))
+
+	// The availability metrics keep their label sets when the reason changes.
+	result = CheckResult{AvailMode: RegistryUnavailable, Reason: "tcp"}
+	clock.advance(time.Hour)
+	checkDue(store)
+	after, reasons := availabilitySeries()
+	assert.ElementsMatch(t, before, after)
+	assert.Equal(t, []string{"tcp"}, reasons)
+
+	result = CheckResult{AvailMode: Available}
+	clock.advance(time.Hour)
+	checkDue(store)
+	after, reasons = availabilitySeries()
+	assert.ElementsMatch(t, before, after)
+	assert.Empty(t, reasons)
+}
+
+func TestImageStore_CollectGarbage(t *testing.T) {
+	store := NewImageStore(func(ImageKey) CheckResult { return CheckResult{} }, testRegistry, 1, 0, time.Minute, time.Hour, 10*time.Minute)
+	info := ContainerInfo{Namespace: "test", ControllerKind: "Deployment", ControllerName: "test", Container: "test"}
+	other := ContainerInfo{Namespace: "test", ControllerKind: "Deployment", ControllerName: "other", Container: "test"}
+	for _, image := range []string{"kept", "changed", "deleted", "reconciled"} {
+		store.ReconcileImage(ImageKey{Image: image}, []ContainerInfo{info})
+	}
+
+	// The image is reconciled after its container infos are collected without the lock, the second collection
+	// under the lock picks it up.
+	reconciled := false
+	store.collectGarbage(func(key ImageKey) []ContainerInfo {
+		switch key.Image {
+		case "changed":
+			return []ContainerInfo{other}
+		case "deleted":
+			return nil
+		case "reconciled":
+			if !reconciled {
+				reconciled = true
+				return nil
+			}
+		}
+		return []ContainerInfo{info}
+	})
+
+	require.Len(t, store.imageSet, 3)
+	require.Equal(t, map[ContainerInfo]struct{}{info: {}}, store.imageSet[ImageKey{Image: "kept"}].ContainerInfo)
+	require.Equal(t, map[ContainerInfo]struct{}{other: {}}, store.imageSet[ImageKey{Image: "changed"}].ContainerInfo)
+	require.Equal(t, map[ContainerInfo]struct{}{info: {}}, store.imageSet[ImageKey{Image: "reconciled"}].ContainerInfo)
 }
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"container/heap"
+	"slices"
+	"time"
+)
+
+// schedule keeps images ordered by the time of their next check. Images are partitioned by registry host, so that
+// a registry with lots of due images does not delay checks of images from other registries.
+type schedule struct {
+	registries map[string]*imageHeap
+	items      map[ImageKey]*scheduledImage
+	// rotation shifts the registry every round-robin pass starts from.
+	rotation int
+}
+
+type scheduledImage struct {
+	key      ImageKey
+	registry string
+	due      time.Time
+	// immediate images are checked before any other image of the registry, see schedule.expedite.
+	immediate bool
+	index     int
+}
+
+// imageHeap implements heap.Interface, immediate images go first, then the image that is due first.
+type imageHeap []*scheduledImage
+
+func (h imageHeap) Len() int { return len(h) }
+
+func (h imageHeap) Less(i, j int) bool {
+	if h[i].immediate != h[j].immediate {
+		return h[i].immediate
+	}
+
+	return h[i].due.Before(h[j].due)
+}
+
+func (h imageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *imageHeap) Push(x any) {
+	item := x.(*scheduledImage)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *imageHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return item
+}
+
+type checkItem struct {
+	key      ImageKey
+	registry string
+	due      time.Time
+}
+
+func newSchedule() *schedule {
+	return &schedule{
+		registries: make(map[string]*imageHeap),
+		items:      make(map[ImageKey]*scheduledImage),
+	}
+}
+
+// push schedules the image to be checked at the due time, rescheduling it if it is already scheduled.
+func (s *schedule) push(registry string, key ImageKey, due time.Time) {
+	if item, ok := s.items[key]; ok {
+		item.due = due
+		item.immediate = false
+		heap.Fix(s.registries[item.registry], item.index)
+		return
+	}
+
+	h, ok := s.registries[registry]
+	if !ok {
+		h = &imageHeap{}
+		s.registries[registry] = h
+	}
+
+	item := &scheduledImage{key: key, registry: registry, due: due}
+	heap.Push(h, item)
+	s.items[key] = item
+}
+
+// expedite makes the scheduled image due at the given time at the latest and moves it ahead of the other images
+// of its registry. An image that is not scheduled, i.e., is being checked, is left as is.
+func (s *schedule) expedite(key ImageKey, now time.Time) {
+	item, ok := s.items[key]
+	if !ok {
+		return
+	}
+
+	if item.due.After(now) {
+		item.due = now
+	}
+	item.immediate = true
+	heap.Fix(s.registries[item.registry], item.index)
+}
+
+func (s *schedule) remove(key ImageKey) {
+	item, ok := s.items[key]
+	if !ok {
+		return
+	}
+
+	h := s.registries[item.registry]
+	heap.Remove(h, item.index)
+	delete(s.items, key)
+
+	if h.Len() == 0 {
+		delete(s.registries, item.registry)
+	}
+}
+
+// next takes the most overdue image of the next registry in turn whose images are due at the given time,
+// registries that are skipped, e.g., because of their in-flight limit, are passed over. The taken image is
+// no longer scheduled until it is pushed back.
+func (s *schedule) next(now time.Time, skip func(registry string) bool) (checkItem, bool) {
+	registries := make([]string, 0, len(s.registries))
+	for registry := range s.registries {
+		registries = append(registries, registry)
+	}
+	if len(registries) == 0 {
+		return checkItem{}, false
+	}
+	slices.Sort(registries)
+
+	start := s.rotation % len(registries)
+	for i := range registries {
+		registry := registries[(start+i)%len(registries)]
+
+		h := s.registries[registry]
+		if (*h)[0].due.After(now) || skip(registry) {
+			continue
+		}
+
+		item := heap.Pop(h).(*scheduledImage)
+		delete(s.items, item.key)
+		if h.Len() == 0 {
+			delete(s.registries, registry)
+		}
+		// The next image is taken from the registry after this one.
+		s.rotation = start + i + 1
+
+		return checkItem{key: item.key, registry: registry, due: item.due}, true
+	}
+
+	return checkItem{}, false
+}
+
+// overdue calls fn for every image that is due at the given time.
+func (s *schedule) overdue(now time.Time, fn func(item *scheduledImage)) {
+	for _, item := range s.items {
+		if !item.due.After(now) {
+			fn(item)
+		}
+	}
+}